@@ -2,6 +2,4 @@ module github.com/maxjmax/clipclop
 
 go 1.19
 
-require (
-	github.com/BurntSushi/xgb v0.0.0-20210121224620-deaf085860bc // indirect
-)
+require github.com/BurntSushi/xgb v0.0.0-20210121224620-deaf085860bc
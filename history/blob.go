@@ -0,0 +1,183 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// previewLen is how much of the first line of a text clip we keep in memory once its contents are in a blob.
+const previewLen = 1024
+
+// Blobs holds the contents of large clips outside of memory, addressed by a hash of their contents.
+type Blobs interface {
+	// Put stores data, if it isn't already stored, and returns its hash.
+	Put(data []byte) (string, error)
+	Open(hash string) (ClipReader, error)
+	Remove(hash string) error
+	// List returns the hashes of every stored blob.
+	List() ([]string, error)
+}
+
+// ClipReader reads the contents of a clip, from memory or from a blob.
+type ClipReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+// SetBlobs moves the contents of clips larger than threshold bytes out of memory and into blobs.
+func (h *History) SetBlobs(b Blobs, threshold int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.blobs = b
+	h.blobThreshold = threshold
+}
+
+// CollectBlobs removes every blob that isn't used by a clip in the history, such as those left behind by a crash.
+func (h *History) CollectBlobs() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.blobs == nil {
+		return nil
+	}
+	hashes, err := h.blobs.List()
+	if err != nil {
+		return fmt.Errorf("could not list blobs: %w", err)
+	}
+	for _, hash := range hashes {
+		h.orphans[hash] = true
+	}
+	return h.collect()
+}
+
+// Open returns a reader for the contents of the clip, which must be closed when done.
+func (c *Clip) Open() (ClipReader, error) {
+	if c.Blob == "" {
+		return memReader{bytes.NewReader(c.Value)}, nil
+	}
+	if c.blobs == nil {
+		return nil, errors.New("clip contents are in a blob, but there is no blob store")
+	}
+	return c.blobs.Open(c.Blob)
+}
+
+// Bytes returns the contents of the clip, reading them in from its blob if need be.
+func (c *Clip) Bytes() ([]byte, error) {
+	if c.Blob == "" {
+		return c.Value, nil
+	}
+	r, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data := make([]byte, c.BlobSize)
+	if _, err = r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// summary returns the first line of a text clip, and the number of lines after it.
+func (c *Clip) summary() (string, int) {
+	if c.Blob != "" {
+		return c.Preview, c.ExtraLines
+	}
+	text := c.Value
+	if c.Format == HtmlFormat {
+		text = []byte(HTMLText(c.Value))
+	}
+	first, _, _ := bytes.Cut(text, []byte{'\n'})
+	return string(first), bytes.Count(text, []byte{'\n'})
+}
+
+// spill moves the contents of c into a blob if it is large enough.
+func (h *History) spill(c *Clip) error {
+	if h.blobs == nil || len(c.Value) <= h.blobThreshold {
+		return nil
+	}
+
+	hash, err := h.blobs.Put(c.Value)
+	if err != nil {
+		return fmt.Errorf("could not store blob: %w", err)
+	}
+
+	first, extra := c.summary()
+	if len(first) > previewLen {
+		first = first[:previewLen]
+		// don't leave part of a rune on the end
+		for i := 0; i < utf8.UTFMax-1; i++ {
+			if r, _ := utf8.DecodeLastRuneInString(first); r != utf8.RuneError {
+				break
+			}
+			first = first[:len(first)-1]
+		}
+	}
+
+	c.Preview, c.ExtraLines = first, extra
+	c.Blob, c.BlobSize = hash, len(c.Value)
+	c.Value = nil
+	c.blobs = h.blobs
+	return nil
+}
+
+// collect removes any blobs released by clips leaving the history, as long as no other clip still uses them. If the
+// history is persisted, the store is compacted first, so that it never refers to a blob that has gone.
+func (h *History) collect() error {
+	if !h.releasable() {
+		return nil
+	}
+	if h.store != nil {
+		return h.compact()
+	}
+	return h.removeOrphans()
+}
+
+// releasable drops any blobs still in use from the orphans, and reports whether any of the rest can be removed.
+func (h *History) releasable() bool {
+	if len(h.orphans) == 0 || h.blobs == nil {
+		return false
+	}
+	h.each(func(c *Clip) bool {
+		delete(h.orphans, c.Blob)
+		return true
+	})
+	for hash := range h.orphans {
+		if h.selected == nil || h.selected.Blob != hash {
+			return true
+		}
+	}
+	return false
+}
+
+// removeOrphans removes the blobs released by clips leaving the history. It must only be called once the store no
+// longer refers to them.
+func (h *History) removeOrphans() error {
+	if !h.releasable() {
+		return nil
+	}
+
+	var err error
+	for hash := range h.orphans {
+		if h.selected != nil && h.selected.Blob == hash {
+			// it may still be pasted, so check it again once something else is selected
+			continue
+		}
+		if rerr := h.blobs.Remove(hash); rerr != nil {
+			err = fmt.Errorf("could not remove blob: %w", rerr)
+		}
+		delete(h.orphans, hash)
+	}
+	return err
+}
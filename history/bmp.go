@@ -0,0 +1,166 @@
+package history
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// The standard library has no BMP support, so this handles the uncompressed 24 and 32 bit images that applications
+// put on the clipboard.
+
+const (
+	bmpFileHeaderLen = 14
+	bmpInfoHeaderLen = 40
+	bmpRGB           = 0 // no compression
+	bmpBitfields     = 3 // no compression, with channel masks, which we assume are the usual BGRA
+)
+
+func init() {
+	image.RegisterFormat("bmp", "BM", decodeBMP, decodeBMPConfig)
+}
+
+type bmpHeader struct {
+	offset      uint32
+	width       int
+	height      int // negative if the rows are stored top down
+	bpp         uint16
+	compression uint32
+}
+
+func readBMPHeader(r io.Reader) (bmpHeader, error) {
+	var h bmpHeader
+	var b [bmpFileHeaderLen + bmpInfoHeaderLen]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return h, err
+	}
+	if string(b[:2]) != "BM" {
+		return h, errors.New("bmp: not a BMP file")
+	}
+	le := binary.LittleEndian
+	h.offset = le.Uint32(b[10:])
+	if infoLen := le.Uint32(b[14:]); infoLen < bmpInfoHeaderLen {
+		return h, fmt.Errorf("bmp: unsupported header size %d", infoLen)
+	}
+	h.width = int(int32(le.Uint32(b[18:])))
+	h.height = int(int32(le.Uint32(b[22:])))
+	h.bpp = le.Uint16(b[28:])
+	h.compression = le.Uint32(b[30:])
+
+	if h.width <= 0 || h.height == 0 {
+		return h, fmt.Errorf("bmp: invalid dimensions %dx%d", h.width, h.height)
+	}
+	if h.bpp != 24 && h.bpp != 32 {
+		return h, fmt.Errorf("bmp: unsupported bit depth %d", h.bpp)
+	}
+	if h.compression != bmpRGB && !(h.compression == bmpBitfields && h.bpp == 32) {
+		return h, fmt.Errorf("bmp: unsupported compression %d", h.compression)
+	}
+	if h.offset < bmpFileHeaderLen+bmpInfoHeaderLen {
+		return h, fmt.Errorf("bmp: invalid pixel offset %d", h.offset)
+	}
+	return h, nil
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	h, err := readBMPHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	height := h.height
+	if height < 0 {
+		height = -height
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: h.width, Height: height}, nil
+}
+
+func decodeBMP(r io.Reader) (image.Image, error) {
+	h, err := readBMPHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	// skip anything between the headers and the pixels, such as the channel masks
+	skip := int64(h.offset) - bmpFileHeaderLen - bmpInfoHeaderLen
+	if _, err = io.CopyN(io.Discard, r, skip); err != nil {
+		return nil, err
+	}
+
+	topDown := h.height < 0
+	height := h.height
+	if topDown {
+		height = -height
+	}
+	if h.width > maxImagePixels/height {
+		return nil, fmt.Errorf("bmp: image is too large: %dx%d", h.width, height)
+	}
+	bytesPerPixel := int(h.bpp) / 8
+	// each row is padded to a multiple of 4 bytes
+	rowLen := (h.width*bytesPerPixel + 3) &^ 3
+
+	// read the pixels before making the image, so that a header claiming more than there is can't make us allocate it
+	data, err := io.ReadAll(io.LimitReader(r, int64(rowLen*height)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < rowLen*height {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, h.width, height))
+	for i := 0; i < height; i++ {
+		row := data[i*rowLen:]
+		y := height - 1 - i
+		if topDown {
+			y = i
+		}
+		pix := img.Pix[y*img.Stride:]
+		for x := 0; x < h.width; x++ {
+			p := row[x*bytesPerPixel:]
+			pix[x*4], pix[x*4+1], pix[x*4+2], pix[x*4+3] = p[2], p[1], p[0], 0xff
+			if bytesPerPixel == 4 && h.compression == bmpBitfields {
+				pix[x*4+3] = p[3]
+			}
+		}
+	}
+	return img, nil
+}
+
+// encodeBMP writes img as an uncompressed 24 bit BMP, which everything can read. Transparency is lost.
+func encodeBMP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	rowLen := (b.Dx()*3 + 3) &^ 3
+	size := bmpFileHeaderLen + bmpInfoHeaderLen + rowLen*b.Dy()
+
+	le := binary.LittleEndian
+	var header [bmpFileHeaderLen + bmpInfoHeaderLen]byte
+	copy(header[:], "BM")
+	le.PutUint32(header[2:], uint32(size))
+	le.PutUint32(header[10:], bmpFileHeaderLen+bmpInfoHeaderLen)
+	le.PutUint32(header[14:], bmpInfoHeaderLen)
+	le.PutUint32(header[18:], uint32(b.Dx()))
+	le.PutUint32(header[22:], uint32(b.Dy())) // bottom up
+	le.PutUint16(header[26:], 1)              // planes
+	le.PutUint16(header[28:], 24)
+	le.PutUint32(header[34:], uint32(rowLen*b.Dy()))
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(header[:]); err != nil {
+		return err
+	}
+	row := make([]byte, rowLen)
+	for y := b.Max.Y - 1; y >= b.Min.Y; y-- {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			i := (x - b.Min.X) * 3
+			row[i], row[i+1], row[i+2] = c.B, c.G, c.R
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,129 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// DefaultDedupWindow is how long after a clip we still consider the next clip as a possible duplicate of it.
+const DefaultDedupWindow = 15 * time.Second
+
+// DedupPolicy decides which clips are duplicates of each other.
+type DedupPolicy interface {
+	// Replaces reports whether next should replace prev, the most recent clip in the history, rather than being
+	// added alongside it.
+	Replaces(prev, next Clip) bool
+	// Key returns the contents used to find duplicates anywhere in the history (see History.SetDedup). Clips with
+	// equal keys are duplicates, and a nil key means the clip is never treated as one.
+	Key(c Clip) []byte
+}
+
+// NewDedupPolicy returns the named policy: substring, exact, prefix, whitespace or none. Clips are only replaced if
+// they come within window of each other; zero means any time.
+func NewDedupPolicy(name string, window time.Duration) (DedupPolicy, error) {
+	switch name {
+	case "substring":
+		return SubstringPolicy{Window: window}, nil
+	case "exact":
+		return ExactPolicy{Window: window}, nil
+	case "prefix":
+		return PrefixPolicy{Window: window}, nil
+	case "whitespace":
+		return WhitespacePolicy{Window: window}, nil
+	case "none":
+		return NonePolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown dedup policy %q", name)
+}
+
+// SubstringPolicy replaces the previous clip if either contains the other. This is the default, and catches
+// selections being both extended and shrunk, at the cost of merging clips such as "foo" after "foobar".
+type SubstringPolicy struct {
+	Window time.Duration
+}
+
+func (p SubstringPolicy) Replaces(prev, next Clip) bool {
+	return sameImage(prev, next, p.Window) || isCandidate(prev, next, p.Window) &&
+		(bytes.Contains(prev.Value, next.Value) || bytes.Contains(next.Value, prev.Value))
+}
+
+func (p SubstringPolicy) Key(c Clip) []byte {
+	return contentKey(c)
+}
+
+// ExactPolicy only replaces the previous clip if it is identical.
+type ExactPolicy struct {
+	Window time.Duration
+}
+
+func (p ExactPolicy) Replaces(prev, next Clip) bool {
+	return sameImage(prev, next, p.Window) || isCandidate(prev, next, p.Window) && bytes.Equal(prev.Value, next.Value)
+}
+
+func (p ExactPolicy) Key(c Clip) []byte {
+	return contentKey(c)
+}
+
+// PrefixPolicy replaces the previous clip if the new one starts with it, which is what we see when a selection grows
+// one step at a time in vim or a terminal.
+type PrefixPolicy struct {
+	Window time.Duration
+}
+
+func (p PrefixPolicy) Replaces(prev, next Clip) bool {
+	return sameImage(prev, next, p.Window) || isCandidate(prev, next, p.Window) && bytes.HasPrefix(next.Value, prev.Value)
+}
+
+func (p PrefixPolicy) Key(c Clip) []byte {
+	return contentKey(c)
+}
+
+// WhitespacePolicy treats text clips as duplicates if they only differ in the amount of whitespace.
+type WhitespacePolicy struct {
+	Window time.Duration
+}
+
+func (p WhitespacePolicy) Replaces(prev, next Clip) bool {
+	return isCandidate(prev, next, p.Window) && bytes.Equal(p.Key(prev), p.Key(next))
+}
+
+func (p WhitespacePolicy) Key(c Clip) []byte {
+	if c.Format != StringFormat || c.Blob != "" {
+		return contentKey(c)
+	}
+	return normaliseSpace(c.Value)
+}
+
+// NonePolicy keeps every clip.
+type NonePolicy struct{}
+
+func (NonePolicy) Replaces(prev, next Clip) bool { return false }
+func (NonePolicy) Key(c Clip) []byte             { return nil }
+
+// isCandidate reports whether next could replace prev. Clips held in blobs are never candidates, as it would mean
+// reading them back in. They can still be found as duplicates by their Key.
+func isCandidate(prev, next Clip, window time.Duration) bool {
+	if prev.Format != next.Format || prev.Blob != "" || next.Blob != "" {
+		return false
+	}
+	return window <= 0 || next.Created.Sub(prev.Created) <= window
+}
+
+// contentKey identifies the contents of a clip: images by what they look like, and others by the hash for clips held
+// in blobs. Clips are only held in blobs above a certain size, so a clip in memory will never have the same contents
+// as one in a blob.
+func contentKey(c Clip) []byte {
+	if k := imageKey(c); k != nil {
+		return k
+	}
+	if c.Blob != "" {
+		return []byte(c.Blob)
+	}
+	return c.Value
+}
+
+// normaliseSpace trims b and collapses any runs of whitespace within it to a single space.
+func normaliseSpace(b []byte) []byte {
+	return bytes.Join(bytes.Fields(b), []byte{' '})
+}
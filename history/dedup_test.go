@@ -0,0 +1,80 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupPolicies(t *testing.T) {
+	now := time.Now()
+	clip := func(s string, age time.Duration) Clip {
+		return Clip{Created: now.Add(-age), Value: []uint8(s), Format: StringFormat}
+	}
+
+	tests := []struct {
+		policy   string
+		prev     Clip
+		next     Clip
+		expected bool
+	}{
+		{"substring", clip("foobar", time.Second), clip("foo", 0), true},
+		{"substring", clip("foo", time.Second), clip("foobar", 0), true},
+		{"substring", clip("foo", time.Minute), clip("foobar", 0), false},
+		{"substring", clip("foo", time.Second), clip("bar", 0), false},
+
+		{"exact", clip("foo", time.Second), clip("foo", 0), true},
+		{"exact", clip("foo", time.Second), clip("foobar", 0), false},
+		{"exact", clip("foo", time.Minute), clip("foo", 0), false},
+
+		{"prefix", clip("foo", time.Second), clip("foobar", 0), true},
+		{"prefix", clip("foobar", time.Second), clip("foo", 0), false},
+		{"prefix", clip("bar", time.Second), clip("foobar", 0), false},
+
+		{"whitespace", clip(" foo  bar\n", time.Second), clip("foo bar", 0), true},
+		{"whitespace", clip("foo bar", time.Second), clip("foobar", 0), false},
+
+		{"none", clip("foo", time.Second), clip("foo", 0), false},
+
+		{"exact", clip("foo", time.Second), Clip{Created: now, Value: []uint8("foo"), Format: PngFormat}, false},
+	}
+
+	for _, tt := range tests {
+		p, err := NewDedupPolicy(tt.policy, DefaultDedupWindow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Replaces(tt.prev, tt.next); got != tt.expected {
+			t.Errorf("%s: %q then %q: got %v expected %v", tt.policy, tt.prev.Value, tt.next.Value, got, tt.expected)
+		}
+	}
+
+	if _, err := NewDedupPolicy("bogus", 0); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestDedupPolicyWindow(t *testing.T) {
+	prev := Clip{Created: time.Now().Add(-time.Hour), Value: []uint8("foo"), Format: StringFormat}
+	next := Clip{Created: time.Now(), Value: []uint8("foo"), Format: StringFormat}
+
+	if !(ExactPolicy{Window: 0}).Replaces(prev, next) {
+		t.Error("A zero window should have no limit")
+	}
+	if (ExactPolicy{Window: time.Minute}).Replaces(prev, next) {
+		t.Error("Clip should be outside the window")
+	}
+}
+
+func TestWhitespaceDedup(t *testing.T) {
+	h := NewHistory(5, nil)
+	h.SetDedup(true)
+	h.SetDedupPolicy(WhitespacePolicy{Window: DefaultDedupWindow})
+
+	start := time.Now().Add(-time.Hour)
+	for i, v := range []string{"foo  bar", "baz", "\tfoo bar\n"} {
+		h.Append(Clip{Created: start.Add(time.Duration(i) * time.Minute), Value: []uint8(v), Format: StringFormat})
+	}
+	if got := getHistoryAsLines(h, "|"); got != "\tfoo bar\n|baz" {
+		t.Errorf("History was wrong: got %q", got)
+	}
+}
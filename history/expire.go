@@ -0,0 +1,66 @@
+package history
+
+import (
+	"time"
+)
+
+// SetExpiry makes clips expire once they are older than maxAge, or sensitiveTTL for sensitive clips. Pinned clips
+// only expire if they are sensitive. Zero means never.
+func (h *History) SetExpiry(maxAge, sensitiveTTL time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.maxAge = maxAge
+	h.sensitiveTTL = sensitiveTTL
+}
+
+// Expire removes any clips that have expired by now. It reports whether the selected clip was one of them, in which
+// case nothing is selected and it should no longer be served.
+func (h *History) Expire(now time.Time) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	removed := 0
+	kept := make([]Clip, 0, len(h.data))
+	for _, c := range h.ordered() {
+		if h.expired(c, now) {
+			h.untrack(c)
+			removed++
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	if removed > 0 {
+		h.reset(kept)
+	}
+
+	pinned := h.pinned[:0]
+	for _, c := range h.pinned {
+		if !h.expired(c, now) {
+			pinned = append(pinned, c)
+			continue
+		}
+		if c.Blob != "" {
+			h.orphans[c.Blob] = true
+		}
+		removed++
+	}
+	h.pinned = pinned
+
+	selectedExpired := h.selected != nil && h.expired(*h.selected, now)
+	if selectedExpired {
+		h.selected = nil
+	}
+
+	if removed == 0 {
+		return selectedExpired, nil
+	}
+	return selectedExpired, h.persistAll()
+}
+
+func (h *History) expired(c Clip, now time.Time) bool {
+	if !c.Expires.IsZero() && !now.Before(c.Expires) {
+		return true
+	}
+	return !c.Pinned && h.maxAge > 0 && !c.Created.IsZero() && now.Sub(c.Created) > h.maxAge
+}
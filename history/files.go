@@ -0,0 +1,69 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Files returns the paths of the files in a file list clip, or their URIs if they aren't local files.
+func (c *Clip) Files() []string {
+	data, err := c.Bytes()
+	if err != nil {
+		return nil
+	}
+	return parseURIList(data)
+}
+
+// parseURIList parses a text/uri-list, as described in RFC 2483.
+func parseURIList(data []byte) []string {
+	var files []string
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		u, err := url.Parse(string(line))
+		if err != nil || u.Scheme != "file" {
+			files = append(files, string(line))
+			continue
+		}
+		files = append(files, u.Path)
+	}
+	return files
+}
+
+// filesSummary describes a list of files in at most max columns, naming as many of them as fit, e.g.
+// "{3 files: report.pdf, …}".
+func filesSummary(files []string, max int) string {
+	noun := "files"
+	if len(files) == 1 {
+		noun = "file"
+	}
+	pre := fmt.Sprintf("{%d %s: ", len(files), noun)
+
+	var names strings.Builder
+	for i, f := range files {
+		name := sanitiseLine(path.Base(f))
+		sep := ""
+		if i > 0 {
+			sep = ", "
+		}
+		rest := ""
+		if i < len(files)-1 {
+			rest = ", …" // in case the next one doesn't fit
+		}
+		if displayWidth(pre+names.String()+sep+name+rest)+1 > max {
+			if i == 0 {
+				names.WriteString("…")
+			} else {
+				names.WriteString(", …")
+			}
+			break
+		}
+		names.WriteString(sep + name)
+	}
+	return pre + names.String() + "}"
+}
@@ -0,0 +1,46 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFiles(t *testing.T) {
+	uris := "# copied from nautilus\r\nfile:///home/me/report.pdf\r\nfile:///home/me/My%20Notes.txt\r\nhttps://example.com/x\r\n"
+	c := Clip{Created: time.Now(), Value: []uint8(uris), Format: FilesFormat}
+
+	expected := []string{"/home/me/report.pdf", "/home/me/My Notes.txt", "https://example.com/x"}
+	if got := c.Files(); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Files were wrong: got %q", got)
+	}
+	if text, _ := c.Text(); string(text) != strings.Join(expected, "\n") {
+		t.Errorf("Text was wrong: got %q", text)
+	}
+	if got := HistoryFormatter(c); got != "[ 0s ago] {3 files: report.pdf, My Notes.txt, x}            " {
+		t.Errorf("Format was wrong: got %q", got)
+	}
+}
+
+func TestFilesSummary(t *testing.T) {
+	tests := []struct {
+		files    []string
+		max      int
+		expected string
+	}{
+		{[]string{"/a/report.pdf"}, 50, "{1 file: report.pdf}"},
+		{[]string{"/a/report.pdf", "/a/b.txt"}, 50, "{2 files: report.pdf, b.txt}"},
+		{[]string{"/a/report.pdf", "/a/b.txt", "/a/c.txt"}, 28, "{3 files: report.pdf, …}"},
+		{[]string{"/a/a-very-long-file-name.pdf", "/b"}, 20, "{2 files: …}"},
+	}
+
+	for _, tt := range tests {
+		got := filesSummary(tt.files, tt.max)
+		if got != tt.expected {
+			t.Errorf("filesSummary(%v, %d) = %q, expected %q", tt.files, tt.max, got, tt.expected)
+		}
+		if displayWidth(got) > tt.max {
+			t.Errorf("filesSummary(%v, %d) is too long: %d", tt.files, tt.max, len(got))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package history
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Filter selects clips by their contents and metadata. The zero value matches everything.
+type Filter struct {
+	Pattern   *regexp.Regexp // matched against the contents of text clips
+	Formats   []ClipFormat
+	Source    string    // case insensitive
+	Selection string    // case insensitive, e.g. primary
+	Since     time.Time // only clips created after this, which excludes presets
+}
+
+func (f Filter) Match(c Clip) bool {
+	if len(f.Formats) > 0 && !containsFormat(f.Formats, c.Format) {
+		return false
+	}
+	if f.Source != "" && !strings.EqualFold(f.Source, c.Source) {
+		return false
+	}
+	if f.Selection != "" && !strings.EqualFold(f.Selection, c.Selection) {
+		return false
+	}
+	if !f.Since.IsZero() && !c.Created.After(f.Since) {
+		return false
+	}
+	if f.Pattern != nil {
+		if !c.Format.IsText() {
+			return false
+		}
+		data, err := c.Text()
+		if err != nil || !f.Pattern.Match(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatsByName returns the formats matching a name used in filters: text (including HTML), html, image or files.
+func FormatsByName(name string) ([]ClipFormat, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return []ClipFormat{StringFormat, HtmlFormat}, nil
+	case "html":
+		return []ClipFormat{HtmlFormat}, nil
+	case "image":
+		return append([]ClipFormat(nil), ImageFormats...), nil
+	case "files":
+		return []ClipFormat{FilesFormat}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", name)
+}
+
+func containsFormat(formats []ClipFormat, f ClipFormat) bool {
+	for _, ff := range formats {
+		if ff == f {
+			return true
+		}
+	}
+	return false
+}
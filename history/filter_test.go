@@ -0,0 +1,44 @@
+package history
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	h := NewHistory(10, []string{"https://preset.example.com"})
+	now := time.Now()
+	for _, c := range []Clip{
+		{Created: now.Add(-3 * time.Hour), Value: []uint8("https://old.example.com"), Format: StringFormat, Source: "firefox"},
+		{Created: now.Add(-2 * time.Hour), Value: []uint8{0x89, 'P', 'N', 'G'}, Format: PngFormat, Source: "gimp"},
+		{Created: now.Add(-time.Hour), Value: []uint8("not a url"), Format: StringFormat, Source: "Alacritty"},
+		{Created: now.Add(-time.Minute), Value: []uint8("see https://new.example.com"), Format: StringFormat, Source: "alacritty", Selection: "PRIMARY"},
+	} {
+		h.Append(c)
+	}
+
+	tests := []struct {
+		filter   Filter
+		expected string
+	}{
+		{Filter{}, "see https://new.example.com|not a url|PNG|https://old.example.com|https://preset.example.com"},
+		{Filter{Pattern: regexp.MustCompile(`https?://`)}, "see https://new.example.com|https://old.example.com|https://preset.example.com"},
+		{Filter{Pattern: regexp.MustCompile(`^https?://`)}, "https://old.example.com|https://preset.example.com"},
+		{Filter{Formats: []ClipFormat{PngFormat}}, "PNG"},
+		{Filter{Source: "ALACRITTY"}, "see https://new.example.com|not a url"},
+		{Filter{Selection: "primary"}, "see https://new.example.com"},
+		{Filter{Since: now.Add(-90 * time.Minute)}, "see https://new.example.com|not a url"},
+		{Filter{Since: now.Add(-90 * time.Minute), Pattern: regexp.MustCompile(`url`)}, "not a url"},
+	}
+
+	for _, tt := range tests {
+		got := strings.Join(h.FormatMatching(func(c Clip) string {
+			return strings.TrimPrefix(string(c.Value), "\x89")
+		}, tt.filter), "|")
+		if got != tt.expected {
+			t.Errorf("Wrong clips for %+v: got %q expected %q", tt.filter, got, tt.expected)
+		}
+	}
+}
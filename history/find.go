@@ -0,0 +1,138 @@
+package history
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Scores for fuzzy matching, loosely following fzf: every matched character scores, with a bonus for continuing a
+// run of consecutive characters or else for matching at the start of a word, and a penalty for each character skipped.
+const (
+	scoreMatch       = 16
+	scoreGap         = -3
+	bonusConsecutive = 12
+	bonusBoundary    = 8
+	bonusFirstChar   = 8
+)
+
+// Find fuzzy matches query against the full contents of every clip matching filter, and returns the matches
+// formatted with f, best first. Matches of equal quality are ordered as they are in Format. Each space separated term
+// in the query must match.
+func (h *History) Find(query string, filter Filter, f func(Clip) string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var terms [][]rune
+	for _, t := range strings.Fields(query) {
+		terms = append(terms, []rune(strings.ToLower(t)))
+	}
+
+	type match struct {
+		clip  *Clip
+		score int
+	}
+	var matches []match
+	h.each(func(c *Clip) bool {
+		if !filter.Match(*c) {
+			return true
+		}
+		// there's nothing useful to match against in the contents of non-text clips, so use the description instead
+		text := HistoryFormatter(*c)
+		if c.Format.IsText() {
+			data, err := c.Text()
+			if err != nil {
+				return true
+			}
+			text = string(data)
+		}
+
+		total := 0
+		for _, t := range terms {
+			score, ok := fuzzyMatch(t, text)
+			if !ok {
+				return true
+			}
+			total += score
+		}
+		matches = append(matches, match{c, total})
+		return true
+	})
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	r := make([]string, 0, len(matches))
+	ids := make([]uint64, 0, len(matches))
+	for _, m := range matches {
+		r = append(r, f(*m.clip))
+		ids = append(ids, m.clip.ID)
+	}
+	h.rememberLines(r, ids)
+	return r
+}
+
+// fuzzyMatch reports whether all of the (lower case) runes of pattern appear in order in text, ignoring case, and
+// scores the best match it finds.
+func fuzzyMatch(pattern []rune, text string) (int, bool) {
+	if len(pattern) == 0 {
+		return 0, true
+	}
+
+	// Find the end of the first complete match, then work backwards from there to find the shortest match ending
+	// at the same place.
+	pi, end := 0, -1
+	for i, r := range text {
+		if unicode.ToLower(r) == pattern[pi] {
+			if pi++; pi == len(pattern) {
+				end = i + utf8.RuneLen(r)
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, false
+	}
+
+	start := end
+	for pi = len(pattern) - 1; pi >= 0; {
+		r, size := utf8.DecodeLastRuneInString(text[:start])
+		start -= size
+		if unicode.ToLower(r) == pattern[pi] {
+			pi--
+		}
+	}
+
+	score, consecutive := 0, false
+	prev, _ := utf8.DecodeLastRuneInString(text[:start])
+	pi = 0
+	for i, r := range text[start:end] {
+		if pi < len(pattern) && unicode.ToLower(r) == pattern[pi] {
+			score += scoreMatch
+			if start+i == 0 {
+				score += bonusFirstChar
+			}
+			if consecutive {
+				score += bonusConsecutive
+			} else if start+i == 0 || isBoundary(prev, r) {
+				score += bonusBoundary
+			}
+			consecutive = true
+			pi++
+		} else {
+			score += scoreGap
+			consecutive = false
+		}
+		prev = r
+	}
+	return score, true
+}
+
+func isBoundary(prev, r rune) bool {
+	if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+		return true
+	}
+	return unicode.IsLower(prev) && unicode.IsUpper(r)
+}
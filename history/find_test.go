@@ -0,0 +1,78 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		ok      bool
+	}{
+		{"", "anything", true},
+		{"abc", "abc", true},
+		{"abc", "a big cat", true},
+		{"abc", "ACB", false},
+		{"ssh", "git clone git@github.com:maxjmax/ssh.git", true},
+		{"更多", "更 多 更", true},
+		{"é", "café", true},
+		{"abcd", "abc", false},
+	}
+
+	for _, tt := range tests {
+		_, ok := fuzzyMatch([]rune(tt.pattern), tt.text)
+		if ok != tt.ok {
+			t.Errorf("%q in %q: got %v expected %v", tt.pattern, tt.text, ok, tt.ok)
+		}
+	}
+
+	better := []struct {
+		pattern string
+		better  string
+		worse   string
+	}{
+		{"foo", "foo", "f o o"},
+		{"foo", "foobar", "barfoo"},
+		{"gc", "git commit", "logic"},
+		{"fb", "fooBar", "afxb"},
+	}
+	for _, tt := range better {
+		b, _ := fuzzyMatch([]rune(tt.pattern), tt.better)
+		w, _ := fuzzyMatch([]rune(tt.pattern), tt.worse)
+		if b <= w {
+			t.Errorf("%q should match %q (%d) better than %q (%d)", tt.pattern, tt.better, b, tt.worse, w)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	h := NewHistory(10, []string{"ssh user@example.com"})
+	start := time.Now().Add(-time.Hour)
+	for i, v := range []string{
+		"sudo systemctl restart sshd",
+		"first line\nssh -i key host",
+		"nothing to see",
+		"s s h",
+	} {
+		h.Append(Clip{Created: start.Add(time.Duration(i) * time.Minute), Value: []uint8(v), Format: StringFormat})
+	}
+
+	format := func(c Clip) string { return strings.SplitN(string(c.Value), "\n", 2)[0] }
+	got := strings.Join(h.Find("ssh", Filter{}, format), "|")
+	expected := "ssh user@example.com|first line|sudo systemctl restart sshd|s s h"
+	if got != expected {
+		t.Errorf("Wrong matches: got %q expected %q", got, expected)
+	}
+
+	got = strings.Join(h.Find("SSH  example", Filter{}, format), "|")
+	if got != "ssh user@example.com" {
+		t.Errorf("Every term should match: got %q", got)
+	}
+
+	if got := h.Find("", Filter{}, format); len(got) != 5 {
+		t.Errorf("Empty query should match everything, got %v", got)
+	}
+}
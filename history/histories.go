@@ -0,0 +1,86 @@
+package history
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Histories keeps the clips copied from each X selection (CLIPBOARD, PRIMARY...) either together in one History, or
+// in a History of their own, and tracks which of them the clip we serve when someone pastes is in.
+type Histories struct {
+	main     *History
+	separate map[string]*History // by selection name, e.g. PRIMARY
+	current  *History            // the one whose selected clip we serve
+	mu       sync.RWMutex
+}
+
+// NewHistories keeps the clips from every selection in main, until Separate is used.
+func NewHistories(main *History) *Histories {
+	return &Histories{main: main, separate: make(map[string]*History), current: main}
+}
+
+// Separate keeps the clips copied from selection in h, rather than with the others.
+func (hs *Histories) Separate(selection string, h *History) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	hs.separate[strings.ToUpper(selection)] = h
+}
+
+// For returns the history that clips copied from selection are kept in. An empty selection is the main history.
+func (hs *Histories) For(selection string) *History {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	if h, ok := hs.separate[strings.ToUpper(selection)]; ok {
+		return h
+	}
+	return hs.main
+}
+
+// All returns every history, the main one first.
+func (hs *Histories) All() []*History {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	all := []*History{hs.main}
+	for _, h := range hs.separate {
+		all = append(all, h)
+	}
+	return all
+}
+
+// SetSelected selects c, which is in h, to be served when someone pastes.
+func (hs *Histories) SetSelected(h *History, c *Clip) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	h.SetSelected(c)
+	hs.current = h
+}
+
+// GetSelected returns the clip to serve when someone pastes, or nil if there is nothing to serve.
+func (hs *Histories) GetSelected() *Clip {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	return hs.current.GetSelected()
+}
+
+// Expire drops expired clips from every history. It reports whether the clip we serve expired, as History.Expire.
+func (hs *Histories) Expire(now time.Time) (bool, error) {
+	var selectedExpired bool
+	var firstErr error
+	for _, h := range hs.All() {
+		expired, err := h.Expire(now)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		hs.mu.RLock()
+		selectedExpired = selectedExpired || (expired && h == hs.current)
+		hs.mu.RUnlock()
+	}
+	return selectedExpired, firstErr
+}
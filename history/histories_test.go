@@ -0,0 +1,46 @@
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistories(t *testing.T) {
+	clipboard, primary := NewHistory(5, nil), NewHistory(2, nil)
+	hs := NewHistories(clipboard)
+	if hs.For("PRIMARY") != clipboard || hs.For("") != clipboard {
+		t.Fatal("Expected every selection to share the main history")
+	}
+
+	hs.Separate("primary", primary)
+	if hs.For("PRIMARY") != primary || hs.For("CLIPBOARD") != clipboard || len(hs.All()) != 2 {
+		t.Fatal("Expected PRIMARY to have its own history")
+	}
+
+	copied, _ := clipboard.Append(newTestClip("copied"))
+	for _, s := range []string{"one", "two", "three"} {
+		primary.Append(newTestClip(s))
+	}
+	if lines := primary.Format(HistoryFormatter); len(lines) != 2 {
+		t.Errorf("Expected PRIMARY to keep its own size, got %q", lines)
+	}
+
+	// we serve the clip selected most recently, whichever history it is in
+	hs.SetSelected(clipboard, &copied)
+	if c := hs.GetSelected(); c == nil || string(c.Value) != "copied" {
+		t.Errorf("Wrong clip selected: %v", c)
+	}
+	hs.SetSelected(primary, primary.Top())
+	if c := hs.GetSelected(); c == nil || string(c.Value) != "three" {
+		t.Errorf("Wrong clip selected: %v", c)
+	}
+
+	primary.SetExpiry(time.Minute, 0)
+	expired, err := hs.Expire(time.Now().Add(time.Hour))
+	if err != nil || !expired {
+		t.Errorf("Expected the selected clip to expire, got %t %v", expired, err)
+	}
+	if c := hs.GetSelected(); c != nil {
+		t.Errorf("Expected nothing to be served, got %v", c)
+	}
+}
@@ -1,12 +1,14 @@
 package history
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"math"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 type ClipFormat int
@@ -17,57 +19,192 @@ const (
 	NoneFormat ClipFormat = iota
 	StringFormat
 	PngFormat
+	HtmlFormat
+	FilesFormat // a text/uri-list
+	JpegFormat
+	GifFormat
+	BmpFormat
 )
 
+// Sources of clips which weren't copied from an application we know.
+const (
+	UnknownSource = "unknown"
+	PresetSource  = "preset"
+)
+
+// maxAppWidth is the most columns the source of a clip can take in a line of history.
+const maxAppWidth = 16
+
 type Clip struct {
+	ID      uint64 // unique within a history, and increasing with each new clip
 	Created time.Time
 	Value   []uint8
 	Format  ClipFormat
-	Source  string
+	Source  string // the application it was copied from, by its WM_CLASS
+	Title   string // the title of the window it was copied from
+	PID     int    // of the application it was copied from, or zero
+	Pinned  bool
+
+	// The X selection it was copied from, e.g. CLIPBOARD or PRIMARY, or empty for presets and older clips.
+	Selection string
+
+	// Other targets the clip was offered in, by name (e.g. text/html), so that formatting survives a paste. Value is
+	// the main one, and is what is shown and searched.
+	Targets map[string][]byte
+
+	// Images are described by their dimensions, a perceptual hash of what they look like, and a hash of their pixels
+	// to spot the same picture encoded differently. The width is zero if the image couldn't be decoded.
+	Width     int
+	Height    int
+	ImageHash uint64
+	PixelHash string
+
+	Sensitive bool      // never written to disk, and expires after the sensitive TTL
+	Expires   time.Time // zero if it only expires with the max age
+
+	// Large clips have their contents held in a blob rather than in Value, along with enough to describe them.
+	Blob       string // hash of the contents
+	BlobSize   int
+	Preview    string // first line of text
+	ExtraLines int    // number of lines after the first
+
+	blobs Blobs
 }
 
 type History struct {
-	data     []Clip
-	presets  []Clip
-	first    int
-	selected *Clip
-	mu       sync.RWMutex
+	data          []Clip
+	pinned        []Clip
+	presets       []Clip
+	first         int
+	nextID        uint64
+	selected      *Clip
+	store         Store
+	dirty         int // appends since the store was last compacted
+	policy        DedupPolicy
+	index         map[clipKey]uint64 // content hash to ID of clips in the ring, only if deduplicating
+	limits        Limits
+	bytes         int // total size of the clips in the ring
+	formatBytes   map[ClipFormat]int
+	blobs         Blobs
+	blobThreshold int
+	orphans       map[string]bool // blobs which may no longer be used
+	maxAge        time.Duration
+	sensitiveTTL  time.Duration
+	mu            sync.RWMutex
+
+	// the lines of the last listing, to find the clip chosen from it whatever the formatter
+	recent   map[string]uint64
+	recentMu sync.Mutex
+}
+
+// Limits bounds the total size of the clips in the history, on top of the number of clips. Zero means no limit.
+type Limits struct {
+	MaxBytes       int
+	MaxFormatBytes []FormatLimit
 }
 
+// FormatLimit bounds the total size of the clips in any of a group of formats, such as every image format.
+type FormatLimit struct {
+	Formats  []ClipFormat
+	MaxBytes int
+}
+
+type clipKey [sha256.Size]byte
+
 func NewHistory(maxSize int, presets []string) *History {
-	presetClips := make([]Clip, 0, len(presets))
+	h := History{
+		data:        make([]Clip, 0, maxSize),
+		presets:     make([]Clip, 0, len(presets)),
+		first:       0,
+		nextID:      1,
+		policy:      SubstringPolicy{Window: DefaultDedupWindow},
+		formatBytes: make(map[ClipFormat]int),
+		orphans:     make(map[string]bool),
+	}
 	for _, s := range presets {
-		presetClips = append(presetClips, Clip{
+		h.presets = append(h.presets, Clip{
+			ID:     h.newID(),
 			Value:  []uint8(s),
 			Format: StringFormat,
-			Source: "preset",
+			Source: PresetSource,
 		})
 	}
+	return &h
+}
+
+// SetDedup enables removing duplicates from anywhere in the history. When a clip is appended with the same contents
+// as an older one (according to the DedupPolicy's Key), the older copy is dropped, so that it moves to the top.
+func (h *History) SetDedup(enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.index = nil
+	if enabled {
+		h.reindex()
+	}
+}
 
-	h := History{
-		data:    make([]Clip, 0, maxSize),
-		presets: presetClips,
-		first:   0,
+// SetDedupPolicy replaces the policy used to spot duplicates, which defaults to a SubstringPolicy.
+func (h *History) SetDedupPolicy(p DedupPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.policy = p
+	if h.index != nil {
+		h.reindex()
 	}
-	return &h
+}
+
+// SetLimits sets the byte limits for the history, evicting the oldest clips if it is already over them.
+func (h *History) SetLimits(l Limits) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.limits = l
+	h.evict()
+	h.collect() // nothing we can do with an error here, the next collect will try again
 }
 
 func (h *History) SetSelected(c *Clip) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if c != nil {
+		// c may point into the ring, which is shifted and overwritten as clips come and go
+		sel := *c
+		c = &sel
+	}
 	h.selected = c
 }
 
+// GetSelected returns the clip to serve when someone pastes, or nil if there is nothing to serve.
 func (h *History) GetSelected() *Clip {
-	if h.selected == nil {
-		return h.Top()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	c := h.selected
+	if c == nil {
+		c = h.top()
 	}
-	return h.selected
+	if c != nil && h.expired(*c, time.Now()) {
+		// it hasn't been swept up yet, but it still mustn't be pasted
+		return nil
+	}
+	return c
 }
 
 func (h *History) Top() *Clip {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	return h.top()
+}
+
+func (h *History) top() *Clip {
 	if len(h.data) < 1 {
+		if len(h.pinned) > 0 {
+			return &h.pinned[len(h.pinned)-1]
+		}
 		if len(h.presets) > 0 {
 			return &h.presets[0]
 		}
@@ -76,15 +213,57 @@ func (h *History) Top() *Clip {
 	return &h.data[h.getEnd()]
 }
 
-func (h *History) Append(c Clip) {
+// Append adds c to the history, and returns it with its newly assigned ID.
+func (h *History) Append(c Clip) (Clip, error) {
+	// decoding an image can take a while, so do it before we block everyone else
+	describeImage(&c)
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	c.ID = h.newID()
+	var err error
+	if c.Sensitive {
+		if h.sensitiveTTL > 0 && c.Expires.IsZero() {
+			c.Expires = c.Created.Add(h.sensitiveTTL)
+		}
+	} else {
+		// if we can't spill it, we can still keep it in memory
+		err = h.spill(&c)
+	}
+	h.append(c)
+
+	// sensitive clips never touch the disk
+	if h.store != nil && !c.Sensitive {
+		h.dirty++
+		if serr := h.store.Append(c); serr != nil {
+			err = fmt.Errorf("could not persist clip: %w", serr)
+		}
+	}
+	// after appending, as collecting may compact the store
+	if cerr := h.collect(); err == nil {
+		err = cerr
+	}
+	return c, err
+}
+
+func (h *History) append(c Clip) {
+	if key, ok := h.key(c); ok {
+		if id, ok := h.index[key]; ok {
+			// drop the older copy, the new one will take its place at the top
+			if i := h.indexOf(id); i >= 0 {
+				h.remove(i)
+			}
+		}
+	}
 	if len(h.data) > 0 {
 		end := h.getEnd()
-		if h.data[end].isDuplicate(c) {
+		if h.policy.Replaces(h.data[end], c) {
 			// replace the end rather than adding a new record
+			h.untrack(h.data[end])
 			h.data[end] = c
+			h.track(c)
+			h.evict()
 			return
 		}
 	}
@@ -92,67 +271,244 @@ func (h *History) Append(c Clip) {
 		// first time through, fill up the buffer
 		h.data = append(h.data, c)
 	} else {
+		h.untrack(h.data[h.first])
 		h.data[h.first] = c
 		// if we reach the end, we loop back around
 		h.first = (h.first + 1) % cap(h.data)
 	}
+	h.track(c)
+	h.evict()
 }
 
 func (h *History) Format(f func(Clip) string) []string {
+	return h.FormatMatching(f, Filter{})
+}
+
+// FormatMatching is like Format, but only includes the clips matching filter.
+func (h *History) FormatMatching(f func(Clip) string, filter Filter) []string {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	cnt := len(h.data) + len(h.presets)
-	r := make([]string, 0, cnt)
-
-	if len(h.data) > 0 {
-		// iterate backwards to show the more recent entries first
-		// TODO: could we extract this looping?
-		i := h.getEnd()
-		for {
-			r = append(r, f(h.data[i]))
-			if i == h.first {
-				break // we've gone full circle
-			}
-			if i--; i < 0 {
-				i = len(h.data) - 1
-			}
+	r := make([]string, 0, len(h.data)+len(h.pinned)+len(h.presets))
+	var ids []uint64
+	h.each(func(c *Clip) bool {
+		if filter.Match(*c) {
+			r = append(r, f(*c))
+			ids = append(ids, c.ID)
 		}
-	}
+		return true
+	})
+	h.rememberLines(r, ids)
+	return r
+}
 
-	// Include the presets at the end
-	for _, p := range h.presets {
-		r = append(r, f(p))
+// rememberLines records the lines of a listing, so that FindEntry can find the clip for any of them.
+func (h *History) rememberLines(lines []string, ids []uint64) {
+	recent := make(map[string]uint64, len(lines))
+	for i, l := range lines {
+		l = strings.Trim(l, "\n ")
+		if _, ok := recent[l]; !ok {
+			recent[l] = ids[i]
+		}
 	}
 
-	return r
+	h.recentMu.Lock()
+	defer h.recentMu.Unlock()
+	h.recent = recent
 }
 
 func (h *History) FindEntry(formatted string) (*Clip, error) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	if len(h.data)+len(h.presets) == 0 {
+	if len(h.data)+len(h.pinned)+len(h.presets) == 0 {
 		return nil, errors.New("empty history")
 	}
 
+	h.recentMu.Lock()
+	id, ok := h.recent[strings.Trim(formatted, "\n ")]
+	h.recentMu.Unlock()
+	if ok {
+		if c, err := h.findByID(id); err == nil {
+			return c, nil
+		}
+	}
+
+	// it may be from an older listing, so try matching it against the default format
 	search, err := removeRelativeTimeString(formatted)
 	if err != nil {
 		return nil, err
 	}
 	search = strings.Trim(search, "\n ")
-	i := h.getEnd()
 
-	isMatch := func(c Clip) bool {
-		s := HistoryFormatter(c)
-		s, _ = removeRelativeTimeString(s)
-		return strings.Trim(s, "\n ") == search
+	var found *Clip
+	h.each(func(c *Clip) bool {
+		s, _ := removeRelativeTimeString(HistoryFormatter(*c))
+		if strings.Trim(s, "\n ") == search {
+			found = c
+		}
+		return found == nil
+	})
+
+	if found == nil {
+		return nil, errors.New("no match found")
 	}
+	return found, nil
+}
+
+// FindByID returns the clip with the given ID, whether it is in the history or a preset.
+func (h *History) FindByID(id uint64) (*Clip, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.findByID(id)
+}
+
+func (h *History) findByID(id uint64) (*Clip, error) {
+	for i := range h.data {
+		if h.data[i].ID == id {
+			return &h.data[i], nil
+		}
+	}
+	for i := range h.pinned {
+		if h.pinned[i].ID == id {
+			return &h.pinned[i], nil
+		}
+	}
+	for i := range h.presets {
+		if h.presets[i].ID == id {
+			return &h.presets[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no clip with ID %d", id)
+}
+
+// Pin moves a clip out of the ring, so that it is never evicted. Pinned clips are listed after the history and
+// before the presets.
+func (h *History) Pin(id uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
+	for i := range h.data {
+		if h.data[i].ID == id {
+			c := h.remove(i)
+			c.Pinned = true
+			h.pinned = append(h.pinned, c)
+			return h.persistAll()
+		}
+	}
+	return fmt.Errorf("no clip with ID %d in history", id)
+}
+
+// Unpin returns a pinned clip to the top of the history, from where it will be evicted as normal. It counts as copied
+// now, so that it isn't expired straight away for having been pinned for longer than the max age.
+func (h *History) Unpin(id uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.pinned {
+		if h.pinned[i].ID == id {
+			c := h.pinned[i]
+			c.Pinned = false
+			c.Created = time.Now()
+			h.pinned = append(h.pinned[:i], h.pinned[i+1:]...)
+			h.append(c)
+			return h.persistAll()
+		}
+	}
+	return fmt.Errorf("no pinned clip with ID %d", id)
+}
+
+// WithID wraps a formatter to prefix each line with the clip ID and a tab, so that a picker can hide it (e.g. with
+// fzf --with-nth 2..) and the chosen clip can be selected exactly.
+func WithID(f func(Clip) string) func(Clip) string {
+	return func(c Clip) string {
+		return fmt.Sprintf("%d\t%s", c.ID, f(c))
+	}
+}
+
+func HistoryFormatter(c Clip) string {
+	var line, post string
+	pre := "[ pinned] "
+	if !c.Pinned {
+		pre = fmt.Sprintf("[%s] ", getRelativeTimeString(c.Created))
+	}
+	if app := c.app(); app != "" {
+		pre = "[" + app + " " + strings.TrimLeft(pre[1:], " ")
+	}
+
+	line, extra := c.describe(lineLen - displayWidth(pre))
+	if extra > 0 {
+		post = fmt.Sprintf(" [+%d lines]", extra)
+	}
+
+	// every line is the same width on screen, however many bytes it takes
+	rem := lineLen - displayWidth(pre) - displayWidth(post)
+	if displayWidth(line) > rem {
+		line = truncateWidth(line, rem-3) + "..."
+	}
+	return pre + line + strings.Repeat(" ", rem-displayWidth(line)) + post
+}
+
+// app returns the name of the application the clip was copied from, fit to show in a line of history, or an empty
+// string if it isn't known. It never contains a ], so that the line can still be found again.
+func (c *Clip) app() string {
+	if c.Source == UnknownSource || c.Source == PresetSource {
+		return ""
+	}
+	app := strings.Map(func(r rune) rune {
+		if r == '[' || r == ']' || unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, sanitiseLine(c.Source))
+	return truncateWidth(app, maxAppWidth)
+}
+
+// describe returns a single line describing the clip, in at most width columns for file lists, and the number of
+// lines of text after it.
+func (c *Clip) describe(width int) (string, int) {
+	if c.Format.IsImage() && c.Width > 0 {
+		return fmt.Sprintf("{%s %dx%d %s}", c.Format.imageName(), c.Width, c.Height, formatSize(c.Size())), 0
+	} else if c.Format.IsImage() {
+		return fmt.Sprintf("{%s image %s}", c.Format.imageName(), formatSize(c.Size())), 0
+	} else if c.Format == FilesFormat {
+		return filesSummary(c.Files(), width), 0
+	}
+	first, extra := c.summary()
+	return sanitiseLine(strings.Trim(first, " \n\t")), extra
+}
+
+// Size returns the size of the contents of the clip, whether they are in memory or in a blob.
+func (c *Clip) Size() int {
+	if c.Blob != "" {
+		return c.BlobSize
+	}
+	return len(c.Value)
+}
+
+func (h *History) newID() uint64 {
+	id := h.nextID
+	h.nextID++
+	return id
+}
+
+// ordered returns the clips in the ring, oldest first.
+func (h *History) ordered() []Clip {
+	r := make([]Clip, 0, len(h.data))
+	r = append(r, h.data[h.first:]...)
+	return append(r, h.data[:h.first]...)
+}
+
+// each calls f for every clip in the order they are listed: the history newest first, then the pinned clips, most
+// recently pinned first, then the presets. It stops early if f returns false.
+func (h *History) each(f func(c *Clip) bool) {
 	if len(h.data) > 0 {
+		// iterate backwards to show the more recent entries first
+		i := h.getEnd()
 		for {
-			if isMatch(h.data[i]) {
-				return &h.data[i], nil
+			if !f(&h.data[i]) {
+				return
 			}
 			if i == h.first {
 				break // we've gone full circle
@@ -163,35 +519,164 @@ func (h *History) FindEntry(formatted string) (*Clip, error) {
 		}
 	}
 
-	for _, p := range h.presets {
-		if isMatch(p) {
-			return &p, nil
+	for i := len(h.pinned) - 1; i >= 0; i-- {
+		if !f(&h.pinned[i]) {
+			return
 		}
 	}
 
-	return nil, errors.New("no match found")
+	for i := range h.presets {
+		if !f(&h.presets[i]) {
+			return
+		}
+	}
 }
 
-func HistoryFormatter(c Clip) string {
-	var line, post string
-	pre := fmt.Sprintf("[%s] ", getRelativeTimeString(c.Created))
+// snapshot returns everything that should be persisted: the ring, oldest first, followed by the pinned clips. Sensitive
+// clips are left out.
+func (h *History) snapshot() []Clip {
+	r := make([]Clip, 0, len(h.data)+len(h.pinned))
+	for _, c := range append(h.ordered(), h.pinned...) {
+		if !c.Sensitive {
+			r = append(r, c)
+		}
+	}
+	return r
+}
 
-	if c.Format == PngFormat {
-		line = fmt.Sprintf("{png image %.1fkB}", float32(len(c.Value))/1024.0)
-	} else {
-		lines := strings.Split(string(c.Value), "\n")
-		line = strings.Trim(lines[0], " \n\t")
-		if len(lines) > 1 {
-			post = fmt.Sprintf(" [+%d lines]", len(lines)-1)
+// remove takes the clip at index i out of the ring and returns it. The clips after it are shifted down in place,
+// unwrapping the ring first if need be, so that a full ring stays ordered oldest first from index 0 while it refills.
+func (h *History) remove(i int) Clip {
+	c := h.data[i]
+	h.untrack(c)
+
+	n := len(h.data)
+	pos := (i - h.first + n) % n
+	if h.first != 0 {
+		// rotate the oldest clip to the start, by reversing both halves and then the whole
+		reverse(h.data[:h.first])
+		reverse(h.data[h.first:])
+		reverse(h.data)
+		h.first = 0
+	}
+	copy(h.data[pos:], h.data[pos+1:])
+	h.data[n-1] = Clip{} // don't hold on to its contents
+	h.data = h.data[:n-1]
+	return c
+}
+
+// reset replaces the ring with clips, oldest first.
+func (h *History) reset(clips []Clip) {
+	h.data = append(make([]Clip, 0, cap(h.data)), clips...)
+	h.first = 0
+}
+
+func reverse(clips []Clip) {
+	for i, j := 0, len(clips)-1; i < j; i, j = i+1, j-1 {
+		clips[i], clips[j] = clips[j], clips[i]
+	}
+}
+
+// indexOf returns the index in the ring of the clip with the given ID, or -1.
+func (h *History) indexOf(id uint64) int {
+	for i := range h.data {
+		if h.data[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// key returns the dedup index key for c, if we are deduplicating and the policy allows it.
+func (h *History) key(c Clip) (clipKey, bool) {
+	if h.index == nil {
+		return clipKey{}, false
+	}
+	k := h.policy.Key(c)
+	if k == nil {
+		return clipKey{}, false
+	}
+	hash := sha256.New()
+	hash.Write([]byte{byte(c.Format)})
+	hash.Write(k)
+
+	var r clipKey
+	hash.Sum(r[:0])
+	return r, true
+}
+
+func (h *History) reindex() {
+	h.index = make(map[clipKey]uint64, cap(h.data))
+	for _, c := range h.ordered() {
+		h.remember(c)
+	}
+}
+
+// track records a clip entering the ring.
+func (h *History) track(c Clip) {
+	h.bytes += c.totalSize()
+	h.formatBytes[c.Format] += c.totalSize()
+	h.remember(c)
+}
+
+// untrack records a clip leaving the ring.
+func (h *History) untrack(c Clip) {
+	h.bytes -= c.totalSize()
+	h.formatBytes[c.Format] -= c.totalSize()
+	h.forget(c)
+	if c.Blob != "" {
+		h.orphans[c.Blob] = true
+	}
+}
+
+// evict removes the oldest clips until the ring is within its limits. The newest clip is always kept.
+func (h *History) evict() {
+	for len(h.data) > 1 {
+		i := h.overLimit()
+		if i < 0 {
+			return
 		}
+		h.remove(i)
 	}
+}
 
-	rem := lineLen - len(pre) - len(post)
-	if len(line) > rem {
-		// TODO: not unicode safe
-		line = line[:(rem-3)] + "..."
+// overLimit returns the index of the next clip to evict to get within the limits, or -1 if we already are.
+func (h *History) overLimit() int {
+	if h.limits.MaxBytes > 0 && h.bytes > h.limits.MaxBytes {
+		return h.first
+	}
+
+	end := h.getEnd()
+	for _, l := range h.limits.MaxFormatBytes {
+		total := 0
+		for _, f := range l.Formats {
+			total += h.formatBytes[f]
+		}
+		if l.MaxBytes <= 0 || total <= l.MaxBytes {
+			continue
+		}
+		// find the oldest clip in any of these formats
+		for i := h.first; i != end; i = (i + 1) % len(h.data) {
+			if containsFormat(l.Formats, h.data[i].Format) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// remember adds a clip in the ring to the dedup index.
+func (h *History) remember(c Clip) {
+	if key, ok := h.key(c); ok {
+		h.index[key] = c.ID
+	}
+}
+
+// forget removes a clip that is leaving the ring from the dedup index.
+func (h *History) forget(c Clip) {
+	if key, ok := h.key(c); ok && h.index[key] == c.ID {
+		delete(h.index, key)
 	}
-	return fmt.Sprintf("%s%*s%s", pre, -rem, line, post)
 }
 
 // undefined if empty
@@ -203,14 +688,6 @@ func (h *History) getEnd() int {
 	return lastIndex
 }
 
-func (c *Clip) isDuplicate(c2 Clip) bool {
-	if c2.Created.Sub(c.Created).Seconds() > 15 {
-		// if 15s have passed, we assume this is not a duplicate
-		return false
-	}
-	return strings.Contains(string(c.Value), string(c2.Value)) || strings.Contains(string(c2.Value), string(c.Value))
-}
-
 func getRelativeTimeString(t time.Time) string {
 	if t.IsZero() {
 		return " preset"
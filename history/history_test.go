@@ -9,7 +9,7 @@ import (
 )
 
 func newTestClip(s string) Clip {
-	return Clip{time.Now(), []uint8(s), StringFormat, "test"}
+	return Clip{Created: time.Now(), Value: []uint8(s), Format: StringFormat, Source: UnknownSource}
 }
 
 func getHistoryAsLines(h *History, sep string) string {
@@ -56,6 +56,134 @@ func TestDuplicates(t *testing.T) {
 	}
 }
 
+func TestDedup(t *testing.T) {
+	h := NewHistory(4, []string{"-"})
+	h.SetDedup(true)
+
+	// space the clips out, so that they aren't caught by the check against the previous clip
+	start := time.Now().Add(-time.Hour)
+	appendAll := func(values ...string) {
+		for _, v := range values {
+			start = start.Add(time.Minute)
+			h.Append(Clip{Created: start, Value: []uint8(v), Format: StringFormat})
+		}
+	}
+
+	appendAll("one", "two", "three", "one")
+	if got := getHistoryAsLines(h, " "); got != "one three two -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+	if h.Top().Created != start {
+		t.Error("Moved clip should have the new timestamp")
+	}
+
+	// "two" is evicted, so the next one is new
+	appendAll("four", "five", "two")
+	if got := getHistoryAsLines(h, " "); got != "two five four one -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	appendAll("five", "five")
+	if got := getHistoryAsLines(h, " "); got != "five two four one -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	h.SetDedup(false)
+	appendAll("one")
+	if got := getHistoryAsLines(h, " "); got != "one five two four -" {
+		t.Errorf("History was wrong without dedup: got %s", got)
+	}
+}
+
+func TestByteLimits(t *testing.T) {
+	h := NewHistory(10, []string{"-"})
+	h.SetLimits(Limits{MaxBytes: 10})
+
+	// use separate times, so nothing is replaced as a duplicate
+	start := time.Now().Add(-time.Hour)
+	appendAll := func(format ClipFormat, values ...string) {
+		for _, v := range values {
+			start = start.Add(time.Minute)
+			h.Append(Clip{Created: start, Value: []uint8(v), Format: format})
+		}
+	}
+
+	appendAll(StringFormat, "aaa", "bbb", "ccc")
+	if got := getHistoryAsLines(h, " "); got != "ccc bbb aaa -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+	appendAll(StringFormat, "dd")
+	if got := getHistoryAsLines(h, " "); got != "dd ccc bbb -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	// A clip over the limit on its own is kept, but nothing else is
+	appendAll(StringFormat, "eeeeeeeeeeee")
+	if got := getHistoryAsLines(h, " "); got != "eeeeeeeeeeee -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	h = NewHistory(10, []string{"-"})
+	h.SetLimits(Limits{MaxFormatBytes: []FormatLimit{{Formats: []ClipFormat{PngFormat}, MaxBytes: 6}}})
+	appendAll(PngFormat, "p1p1")
+	appendAll(StringFormat, "t1t1t1t1")
+	appendAll(PngFormat, "p2p2")
+	appendAll(StringFormat, "t2t2t2t2")
+	if got := getHistoryAsLines(h, " "); got != "t2t2t2t2 p2p2 t1t1t1t1 -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	// Tightening the limits applies straight away
+	h.SetLimits(Limits{MaxBytes: 12})
+	if got := getHistoryAsLines(h, " "); got != "t2t2t2t2 p2p2 -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	// A limit on a group of formats is shared between them
+	h = NewHistory(10, []string{"-"})
+	h.SetLimits(Limits{MaxFormatBytes: []FormatLimit{{Formats: []ClipFormat{PngFormat, JpegFormat}, MaxBytes: 10}}})
+	appendAll(PngFormat, "p1p1")
+	appendAll(JpegFormat, "j1j1")
+	appendAll(StringFormat, "t1t1t1t1")
+	appendAll(JpegFormat, "j2j2")
+	if got := getHistoryAsLines(h, " "); got != "j2j2 t1t1t1t1 j1j1 -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	h := NewHistory(5, nil)
+	h.SetLimits(Limits{MaxBytes: 40})
+
+	rich := newTestClip("rich")
+	rich.Targets = map[string][]byte{"text/rtf": []byte("{\\rtf1 rich}"), "text/html": []byte("<b>rich</b>")}
+	c, _ := h.Append(rich)
+
+	if got := c.TargetNames(); strings.Join(got, " ") != "text/html text/rtf" {
+		t.Errorf("Target names were wrong: got %v", got)
+	}
+	r, size, err := c.OpenTarget("text/html")
+	if err != nil || size != 11 {
+		t.Fatalf("Could not open target: %d %s", size, err)
+	}
+	data := make([]byte, size)
+	r.ReadAt(data, 0)
+	r.Close()
+	if string(data) != "<b>rich</b>" {
+		t.Errorf("Target contents were wrong: got %q", data)
+	}
+	if _, _, err = c.OpenTarget("image/png"); err == nil {
+		t.Error("Expected an error opening a missing target")
+	}
+
+	// the other targets count towards the limits (4 + 13 + 11 bytes)
+	h.Append(newTestClip("some text"))
+	h.Append(newTestClip("other words"))
+	if got := getHistoryAsLines(h, " "); got != "other words some text" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+}
+
 func TestHistoryFormat(t *testing.T) {
 	stringTests := []struct {
 		expected string
@@ -79,8 +207,12 @@ func TestHistoryFormat(t *testing.T) {
 		expected string
 		in       Clip
 	}{
-		{"[ 0s ago] {png image 0.0kB}                                 ", Clip{time.Now(), []uint8{}, PngFormat, "test"}},
-		{"[ preset] always                                            ", Clip{time.Time{}, []uint8("always"), StringFormat, "test"}},
+		{"[ 0s ago] {png image 0B}                                    ", Clip{Created: time.Now(), Value: []uint8{}, Format: PngFormat, Source: UnknownSource}},
+		{"[ preset] always                                            ", Clip{Created: time.Time{}, Value: []uint8("always"), Format: StringFormat, Source: UnknownSource}},
+		{"[ 0s ago] Title                                   [+1 lines]", Clip{Created: time.Now(), Value: []uint8("<h1>Title</h1><p>Some <b>bold</b> text</p>"), Format: HtmlFormat, Source: UnknownSource}},
+		{"[firefox 8s ago] a link                                     ", Clip{Created: time.Now().Add(-8 * time.Second), Value: []uint8("a link"), Format: StringFormat, Source: "firefox"}},
+		{"[firefox pinned] a link                                     ", Clip{Created: time.Now(), Value: []uint8("a link"), Format: StringFormat, Source: "firefox", Pinned: true}},
+		{"[SomeLongClassNam 0s ago] x                                 ", Clip{Created: time.Now(), Value: []uint8("x"), Format: StringFormat, Source: "Some]Long[Class Name"}},
 	}
 
 	for _, tt := range otherTests {
@@ -115,7 +247,7 @@ func TestHistorySelect(t *testing.T) {
 		h := NewHistory(10, presets)
 		for i, str := range e {
 			// separate the clip times to avoid removal of dups
-			clip := Clip{time.Now().Add(time.Hour * time.Duration(i)), []uint8(str), StringFormat, "test"}
+			clip := Clip{Created: time.Now().Add(time.Hour * time.Duration(i)), Value: []uint8(str), Format: StringFormat, Source: UnknownSource}
 			clips = append(clips, clip)
 			h.Append(clip)
 		}
@@ -137,6 +269,158 @@ func TestHistorySelect(t *testing.T) {
 	}
 }
 
+func TestHistoryIDs(t *testing.T) {
+	h := NewHistory(10, []string{"preset"})
+	prefix := strings.Repeat("same first line ", 5)
+
+	var ids []uint64
+	for i, str := range []string{prefix + "one", prefix + "two", "different"} {
+		c, err := h.Append(Clip{Created: time.Now().Add(time.Hour * time.Duration(i)), Value: []uint8(str), Format: StringFormat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) > 0 && c.ID <= ids[len(ids)-1] {
+			t.Errorf("IDs should increase, got %d after %v", c.ID, ids)
+		}
+		ids = append(ids, c.ID)
+	}
+
+	for i, str := range []string{prefix + "one", prefix + "two"} {
+		c, err := h.FindByID(ids[i])
+		if err != nil {
+			t.Fatalf("Could not find clip %d: %s", ids[i], err)
+		}
+		if string(c.Value) != str {
+			t.Errorf("Wrong clip found for %d: %s", ids[i], c.Value)
+		}
+	}
+
+	if _, err := h.FindByID(12345); err == nil {
+		t.Error("Expected an error finding an unknown ID")
+	}
+
+	lines := h.Format(WithID(func(c Clip) string { return string(c.Value) }))
+	if expected := fmt.Sprintf("%d\tdifferent", ids[2]); lines[0] != expected {
+		t.Errorf("Wrong line: got %q expected %q", lines[0], expected)
+	}
+	if preset := lines[len(lines)-1]; preset != "1\tpreset" {
+		t.Errorf("Preset should have an ID too, got %q", preset)
+	}
+}
+
+func TestPinning(t *testing.T) {
+	h := NewHistory(3, []string{"-"})
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		c, _ := h.Append(newTestClip(fmt.Sprint(i)))
+		ids = append(ids, c.ID)
+	}
+
+	if err := h.Pin(ids[0]); err != nil {
+		t.Fatalf("Could not pin: %s", err)
+	}
+	if err := h.Pin(ids[0]); err == nil {
+		t.Error("Expected an error pinning a clip twice")
+	}
+	if err := h.Pin(ids[2]); err != nil {
+		t.Fatalf("Could not pin: %s", err)
+	}
+
+	// Pinned clips do not take up room in the ring
+	for i := 3; i < 7; i++ {
+		h.Append(newTestClip(fmt.Sprint(i)))
+	}
+	if got := getHistoryAsLines(h, " "); got != "6 5 4 2 0 -" {
+		t.Errorf("History was wrong: got %s", got)
+	}
+
+	c, err := h.FindByID(ids[0])
+	if err != nil || !c.Pinned {
+		t.Fatalf("Could not find pinned clip: %v %s", c, err)
+	}
+	if got := HistoryFormatter(*c); !strings.HasPrefix(got, "[ pinned] 0") {
+		t.Errorf("Pinned clip formatted wrongly: %q", got)
+	}
+
+	if err := h.Unpin(ids[0]); err != nil {
+		t.Fatalf("Could not unpin: %s", err)
+	}
+	if err := h.Unpin(ids[0]); err == nil {
+		t.Error("Expected an error unpinning a clip twice")
+	}
+	if got := getHistoryAsLines(h, " "); got != "0 6 5 2 -" {
+		t.Errorf("History was wrong after unpinning: got %s", got)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Now()
+	h := NewHistory(5, []string{"-"})
+	h.SetExpiry(time.Hour, time.Minute)
+
+	old := newTestClip("old")
+	old.Created = now.Add(-2 * time.Hour)
+	pinned := newTestClip("pinned")
+	pinned.Created = now.Add(-2 * time.Hour)
+	secret := newTestClip("secret")
+	secret.Created = now
+	secret.Sensitive = true
+
+	h.Append(old)
+	p, _ := h.Append(pinned)
+	if err := h.Pin(p.ID); err != nil {
+		t.Fatalf("Could not pin: %s", err)
+	}
+	h.Append(newTestClip("new"))
+	s, _ := h.Append(secret)
+	if s.Expires != now.Add(time.Minute) {
+		t.Errorf("Sensitive clip expires at the wrong time: %s", s.Expires)
+	}
+	h.SetSelected(&s)
+
+	selectedExpired, err := h.Expire(now)
+	if err != nil || selectedExpired {
+		t.Fatalf("Unexpected expiry: %t %s", selectedExpired, err)
+	}
+	if got := getHistoryAsLines(h, " "); got != "secret new pinned -" {
+		t.Errorf("History was wrong after expiring old clips: got %s", got)
+	}
+
+	selectedExpired, err = h.Expire(now.Add(time.Minute))
+	if err != nil || !selectedExpired {
+		t.Fatalf("Expected the selected clip to expire: %t %s", selectedExpired, err)
+	}
+	if got := getHistoryAsLines(h, " "); got != "new pinned -" {
+		t.Errorf("History was wrong after expiring sensitive clips: got %s", got)
+	}
+	if c := h.GetSelected(); c == nil || string(c.Value) != "new" {
+		t.Errorf("Expected the top clip to be selected, got %v", c)
+	}
+}
+
+func TestUnpinExpired(t *testing.T) {
+	h := NewHistory(5, nil)
+	h.SetExpiry(time.Hour, 0)
+
+	old := newTestClip("pinned long ago")
+	old.Created = time.Now().Add(-2 * time.Hour)
+	c, _ := h.Append(old)
+	if err := h.Pin(c.ID); err != nil {
+		t.Fatalf("Could not pin: %s", err)
+	}
+	h.Append(newTestClip("newer"))
+	if err := h.Unpin(c.ID); err != nil {
+		t.Fatalf("Could not unpin: %s", err)
+	}
+
+	if _, err := h.Expire(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := getHistoryAsLines(h, " "); got != "pinned long ago newer" {
+		t.Errorf("Unpinned clip should be kept at the top: got %s", got)
+	}
+}
+
 func TestHistoryTimeString(t *testing.T) {
 	durations :=
 		[]struct {
@@ -0,0 +1,105 @@
+package history
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// Tags whose contents aren't text, and tags which start a new line.
+var (
+	skipTags  = map[string]bool{"head": true, "script": true, "style": true, "template": true, "title": true}
+	blockTags = map[string]bool{
+		"address": true, "article": true, "aside": true, "blockquote": true, "br": true, "dd": true, "div": true,
+		"dl": true, "dt": true, "figcaption": true, "footer": true, "h1": true, "h2": true, "h3": true, "h4": true,
+		"h5": true, "h6": true, "header": true, "hr": true, "li": true, "ol": true, "p": true, "pre": true,
+		"section": true, "table": true, "tr": true, "ul": true,
+	}
+)
+
+// HTMLText renders HTML as plain text, roughly as a browser would show it: tags are dropped, block elements start new
+// lines, whitespace is collapsed and entities are decoded. It makes no attempt to handle broken markup well.
+func HTMLText(data []byte) string {
+	var b strings.Builder
+	s := string(data)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			writeHTMLText(&b, s)
+			break
+		}
+		writeHTMLText(&b, s[:i])
+		s = s[i:]
+
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end < 0 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+
+		end := strings.IndexByte(s, '>')
+		if end < 0 {
+			break
+		}
+		name, closing := tagName(s[1:end])
+		s = s[end+1:]
+
+		if !closing && skipTags[name] {
+			end = strings.Index(strings.ToLower(s), "</"+name)
+			if end < 0 {
+				break
+			}
+			s = s[end:]
+			continue
+		}
+		if blockTags[name] {
+			b.WriteByte('\n')
+		}
+	}
+
+	// drop the blank lines left by nested blocks, and the spaces around them
+	lines := strings.Split(b.String(), "\n")
+	r := lines[:0]
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			r = append(r, l)
+		}
+	}
+	return strings.Join(r, "\n")
+}
+
+// writeHTMLText writes text from between tags, collapsing runs of whitespace into a single space as HTML does.
+func writeHTMLText(b *strings.Builder, text string) {
+	space := false
+	var collapsed strings.Builder
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space {
+			collapsed.WriteByte(' ')
+			space = false
+		}
+		collapsed.WriteRune(r)
+	}
+	if space {
+		collapsed.WriteByte(' ')
+	}
+	b.WriteString(html.UnescapeString(collapsed.String()))
+}
+
+// tagName returns the lower case name of the tag with the given contents (between < and >), and whether it is a
+// closing tag.
+func tagName(tag string) (string, bool) {
+	closing := strings.HasPrefix(tag, "/")
+	tag = strings.TrimPrefix(tag, "/")
+	end := strings.IndexFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == '/' })
+	if end >= 0 {
+		tag = tag[:end]
+	}
+	return strings.ToLower(tag), closing
+}
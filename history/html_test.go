@@ -0,0 +1,55 @@
+package history
+
+import (
+	"testing"
+)
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"<b>bold</b> and <i>italic</i>", "bold and italic"},
+		{"<p>one</p><p>two</p>", "one\ntwo"},
+		{"line<br>break<BR/>again", "line\nbreak\nagain"},
+		{"<ul>\n  <li>a</li>\n  <li>b</li>\n</ul>", "a\nb"},
+		{"spread\n   over   lines", "spread over lines"},
+		{"fish &amp; chips &lt;3 &quot;x&quot;&nbsp;y", "fish & chips <3 \"x\"\u00a0y"},
+		{"<html><head><title>T</title><style>p { color: red }</style></head><body>body</body></html>", "body"},
+		{"before<script>if (a < b) { x() }</script>after", "beforeafter"},
+		{"a<!-- <p>hidden</p> -->b", "ab"},
+		{"<meta charset='utf-8'><a href=\"https://example.com\">link</a>", "link"},
+		{"unclosed <b", "unclosed"},
+	}
+
+	for _, tt := range tests {
+		if got := HTMLText([]byte(tt.in)); got != tt.expected {
+			t.Errorf("HTMLText(%q) = %q, expected %q", tt.in, got, tt.expected)
+		}
+	}
+}
+
+func TestHTMLClip(t *testing.T) {
+	c := Clip{Value: []uint8("<p>Hello <b>world</b></p>"), Format: HtmlFormat}
+	text, err := c.Text()
+	if err != nil || string(text) != "Hello world" {
+		t.Errorf("Text was wrong: got %q %v", text, err)
+	}
+
+	r, size, err := c.OpenText()
+	if err != nil || size != len("Hello world") {
+		t.Fatalf("Could not open text: %d %s", size, err)
+	}
+	defer r.Close()
+	data := make([]byte, size)
+	r.ReadAt(data, 0)
+	if string(data) != "Hello world" {
+		t.Errorf("OpenText was wrong: got %q", data)
+	}
+
+	formats, _ := FormatsByName("text")
+	if !(Filter{Formats: formats}).Match(c) {
+		t.Error("Expected HTML clips to match the text format")
+	}
+}
@@ -0,0 +1,236 @@
+package history
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"sync"
+	"time"
+)
+
+// ImageFormats are the image formats we can capture, and convert between when pasting.
+var ImageFormats = []ClipFormat{PngFormat, JpegFormat, GifFormat, BmpFormat}
+
+// jpegQuality is used when converting images to JPEG.
+const jpegQuality = 90
+
+// maxImagePixels is the largest image we will decode, which is enough for an 8K screenshot. The dimensions are read
+// from the header first, so that a small file claiming to be huge can't make us allocate it.
+const maxImagePixels = 1 << 25
+
+// converted holds the last image converted for pasting, as the same one is usually asked for again and again.
+var converted struct {
+	key  string // the pixel hash of the image, and the format it was converted to
+	data []byte
+	mu   sync.Mutex
+}
+
+// IsImage reports whether clips in this format hold an image.
+func (f ClipFormat) IsImage() bool {
+	return containsFormat(ImageFormats, f)
+}
+
+// imageName is the short name of an image format, as shown in the history.
+func (f ClipFormat) imageName() string {
+	switch f {
+	case PngFormat:
+		return "png"
+	case JpegFormat:
+		return "jpeg"
+	case GifFormat:
+		return "gif"
+	case BmpFormat:
+		return "bmp"
+	}
+	return "image"
+}
+
+// OpenImage returns a reader for the image in the clip encoded in format f, and its size. If the image isn't already
+// in that format, it is converted, and the result kept for the next time the same conversion is asked for.
+func (c *Clip) OpenImage(f ClipFormat) (ClipReader, int, error) {
+	if f == c.Format {
+		return c.OpenTarget("")
+	}
+	if !c.Format.IsImage() || !f.IsImage() {
+		return nil, 0, fmt.Errorf("cannot convert %s to %s", c.Format.imageName(), f.imageName())
+	}
+
+	key := c.PixelHash + " " + f.imageName()
+	converted.mu.Lock()
+	defer converted.mu.Unlock()
+	if c.PixelHash != "" && converted.key == key {
+		return memReader{bytes.NewReader(converted.data)}, len(converted.data), nil
+	}
+
+	data, err := c.Bytes()
+	if err != nil {
+		return nil, 0, err
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not decode image: %w", err)
+	}
+
+	var buf bytes.Buffer
+	switch f {
+	case PngFormat:
+		err = png.Encode(&buf, img)
+	case JpegFormat:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	case GifFormat:
+		err = gif.Encode(&buf, img, nil)
+	case BmpFormat:
+		err = encodeBMP(&buf, img)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not encode image as %s: %w", f.imageName(), err)
+	}
+	if c.PixelHash != "" {
+		converted.key, converted.data = key, buf.Bytes()
+	}
+	return memReader{bytes.NewReader(buf.Bytes())}, buf.Len(), nil
+}
+
+// hashWidth and hashHeight are the size of the grid an image is shrunk to for its perceptual hash. Each bit of the
+// hash compares horizontally neighbouring cells, giving 64 bits.
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+// describeImage records the dimensions and hashes of an image clip, if they aren't already known. Clips that can't be
+// decoded, or are too large to, are left as they are.
+func describeImage(c *Clip) {
+	if !c.Format.IsImage() || c.PixelHash != "" {
+		return
+	}
+	data, err := c.Bytes()
+	if err != nil {
+		return
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return
+	}
+	b := img.Bounds()
+	c.Width, c.Height = b.Dx(), b.Dy()
+	c.ImageHash = imageHash(img)
+	c.PixelHash = pixelHash(img)
+}
+
+// decodeImage decodes data as any of the image formats we know, as long as it is no larger than maxImagePixels.
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Height > 0 && cfg.Width > maxImagePixels/cfg.Height {
+		return nil, fmt.Errorf("image is too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if img.Bounds().Empty() {
+		return nil, errors.New("image is empty")
+	}
+	return img, nil
+}
+
+// pixelHash returns a hash of the dimensions and every pixel of img, so that the same picture has the same hash
+// whatever its encoding, and any change to it gives a different one.
+func pixelHash(img image.Image) string {
+	hash := sha256.New()
+	b := img.Bounds()
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(buf[4:], uint32(b.Dy()))
+	hash.Write(buf[:])
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			binary.BigEndian.PutUint16(buf[0:], uint16(r))
+			binary.BigEndian.PutUint16(buf[2:], uint16(g))
+			binary.BigEndian.PutUint16(buf[4:], uint16(bl))
+			binary.BigEndian.PutUint16(buf[6:], uint16(a))
+			hash.Write(buf[:])
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// imageHash returns a difference hash of img: it is shrunk to a small greyscale grid, and each bit records whether a
+// cell is brighter than the one to its right. Images which look the same have the same hash, whatever their encoding,
+// and images which look similar have hashes that differ in few bits.
+func imageHash(img image.Image) uint64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+
+	var sums [hashHeight][hashWidth]uint64
+	var counts [hashHeight][hashWidth]uint64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cy := (y - b.Min.Y) * hashHeight / b.Dy()
+		for x := b.Min.X; x < b.Max.X; x++ {
+			cx := (x - b.Min.X) * hashWidth / b.Dx()
+			r, g, bl, _ := img.At(x, y).RGBA()
+			// ITU-R 601 luma, in the same 16 bit range as the components
+			sums[cy][cx] += (299*uint64(r) + 587*uint64(g) + 114*uint64(bl)) / 1000
+			counts[cy][cx]++
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			hash <<= 1
+			if mean(sums[y][x], counts[y][x]) > mean(sums[y][x+1], counts[y][x+1]) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+func mean(sum, count uint64) uint64 {
+	if count == 0 {
+		return 0
+	}
+	return sum / count
+}
+
+// sameImage reports whether prev and next are the same picture, however they were encoded, and next came within
+// window of prev.
+func sameImage(prev, next Clip, window time.Duration) bool {
+	if prev.PixelHash == "" || prev.PixelHash != next.PixelHash {
+		return false
+	}
+	return window <= 0 || next.Created.Sub(prev.Created) <= window
+}
+
+// imageKey identifies the picture in an image clip, for finding duplicates. It is nil if the image couldn't be
+// decoded, or was described before we hashed its pixels.
+func imageKey(c Clip) []byte {
+	if c.PixelHash == "" {
+		return nil
+	}
+	return []byte("image " + c.PixelHash)
+}
+
+// formatSize describes a number of bytes for people, e.g. 312kB.
+func formatSize(n int) string {
+	switch {
+	case n < 1024:
+		return fmt.Sprintf("%dB", n)
+	case n < 1024*1024:
+		return fmt.Sprintf("%.0fkB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+}
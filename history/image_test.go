@@ -0,0 +1,228 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testImage(w, h int, invert bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x*x + y*3) % 256)
+			if invert {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image, level png.CompressionLevel) []byte {
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: level}
+	if err := enc.Encode(&buf, img); err != nil {
+		t.Fatalf("Could not encode image: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDescribeImage(t *testing.T) {
+	img := testImage(120, 80, false)
+	fast := Clip{Created: time.Now(), Value: encodePNG(t, img, png.BestSpeed), Format: PngFormat}
+	small := Clip{Created: time.Now(), Value: encodePNG(t, img, png.BestCompression), Format: PngFormat}
+	other := Clip{Created: time.Now(), Value: encodePNG(t, testImage(120, 80, true), png.BestSpeed), Format: PngFormat}
+	broken := Clip{Created: time.Now(), Value: []uint8("\x89PNG not really"), Format: PngFormat}
+	for _, c := range []*Clip{&fast, &small, &other, &broken} {
+		describeImage(c)
+	}
+
+	if fast.Width != 120 || fast.Height != 80 {
+		t.Errorf("Dimensions were wrong: got %dx%d", fast.Width, fast.Height)
+	}
+	if bytes.Equal(fast.Value, small.Value) || fast.ImageHash != small.ImageHash {
+		t.Errorf("Expected the same image encoded differently to have the same hash: %x %x", fast.ImageHash, small.ImageHash)
+	}
+	if fast.ImageHash == other.ImageHash {
+		t.Errorf("Expected different images to have different hashes: %x", fast.ImageHash)
+	}
+	if broken.Width != 0 {
+		t.Errorf("Expected a broken image to be left alone: got %dx%d", broken.Width, broken.Height)
+	}
+
+	if got := HistoryFormatter(fast); got[:len("[ 0s ago] {png 120x80 ")] != "[ 0s ago] {png 120x80 " {
+		t.Errorf("Format was wrong: got %q", got)
+	}
+
+	// copying the same screenshot twice only keeps it once, by default straight away and with dedup from anywhere
+	h := NewHistory(5, nil)
+	h.Append(fast)
+	h.Append(small)
+	if n := len(h.Format(HistoryFormatter)); n != 1 {
+		t.Errorf("Expected the same image to replace the previous one, got %d clips", n)
+	}
+
+	h = NewHistory(5, nil)
+	h.SetDedup(true)
+	h.Append(fast)
+	h.Append(newTestClip("in between"))
+	h.Append(other)
+	h.Append(small)
+	if n := len(h.Format(HistoryFormatter)); n != 3 {
+		t.Errorf("Expected the same image to be deduplicated, got %d clips", n)
+	}
+
+	// images that look alike to the perceptual hash are still different pictures
+	h = NewHistory(5, nil)
+	h.SetDedup(true)
+	for _, c := range []color.Color{color.White, color.RGBA{255, 0, 0, 255}, color.Black} {
+		h.Append(Clip{Created: time.Now(), Value: encodePNG(t, solidImage(50, 50, c), png.BestSpeed), Format: PngFormat})
+	}
+	if n := len(h.Format(HistoryFormatter)); n != 3 {
+		t.Errorf("Expected differently coloured images to be kept, got %d clips", n)
+	}
+
+	// an image too large to decode is kept, but not described
+	data := encodePNG(t, solidImage(1, 1, color.White), png.BestSpeed)
+	binary.BigEndian.PutUint32(data[16:], 1<<16) // the width and height in the IHDR chunk
+	binary.BigEndian.PutUint32(data[20:], 1<<16)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	hugeClip := Clip{Created: time.Now(), Value: data, Format: PngFormat}
+	describeImage(&hugeClip)
+	if hugeClip.Width != 0 {
+		t.Errorf("Expected a huge image not to be decoded: got %dx%d", hugeClip.Width, hugeClip.Height)
+	}
+}
+
+func solidImage(w, h int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n        int
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1kB"},
+		{312 * 1024, "312kB"},
+		{3 * 1024 * 1024 / 2, "1.5MB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.expected {
+			t.Errorf("formatSize(%d) = %q, expected %q", tt.n, got, tt.expected)
+		}
+	}
+}
+
+func TestConvertImage(t *testing.T) {
+	img := testImage(33, 17, false)
+	c := Clip{Created: time.Now(), Value: encodePNG(t, img, png.DefaultCompression), Format: PngFormat}
+
+	for _, f := range ImageFormats {
+		r, size, err := c.OpenImage(f)
+		if err != nil {
+			t.Fatalf("Could not convert to %s: %s", f.imageName(), err)
+		}
+		data := make([]byte, size)
+		r.ReadAt(data, 0)
+		r.Close()
+
+		converted := Clip{Created: time.Now(), Value: data, Format: f}
+		describeImage(&converted)
+		if converted.Width != 33 || converted.Height != 17 {
+			t.Errorf("Converting to %s gave the wrong dimensions: %dx%d", f.imageName(), converted.Width, converted.Height)
+		}
+		if !strings.HasPrefix(HistoryFormatter(converted), "[ 0s ago] {"+f.imageName()+" 33x17 ") {
+			t.Errorf("Format was wrong: got %q", HistoryFormatter(converted))
+		}
+	}
+
+	// the last conversion is kept, rather than converting on every paste
+	describeImage(&c)
+	first, size, _ := c.OpenImage(JpegFormat)
+	if converted.key != c.PixelHash+" jpeg" || len(converted.data) != size {
+		t.Errorf("Expected the conversion to be kept, got %q", converted.key)
+	}
+	again, _, _ := c.OpenImage(JpegFormat)
+	a, b := make([]byte, size), make([]byte, size)
+	first.ReadAt(a, 0)
+	again.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Error("Expected the kept conversion to be served again")
+	}
+
+	text := newTestClip("text")
+	if _, _, err := text.OpenImage(PngFormat); err == nil {
+		t.Error("Expected an error converting text to an image")
+	}
+}
+
+func TestBMP(t *testing.T) {
+	img := testImage(5, 3, false) // rows that need padding
+	var buf bytes.Buffer
+	if err := encodeBMP(&buf, img); err != nil {
+		t.Fatalf("Could not encode: %s", err)
+	}
+	decoded, format, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil || format != "bmp" {
+		t.Fatalf("Could not decode: %s %s", format, err)
+	}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			r1, g1, b1, _ := img.At(x, y).RGBA()
+			r2, g2, b2, _ := decoded.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 {
+				t.Fatalf("Pixel %d,%d did not survive the round trip", x, y)
+			}
+		}
+	}
+
+	// a top down 32 bit image, with alpha
+	data := make([]byte, 54+2*4)
+	copy(data, "BM")
+	binary.LittleEndian.PutUint32(data[10:], 54)
+	binary.LittleEndian.PutUint32(data[14:], 40)
+	binary.LittleEndian.PutUint32(data[18:], 1)
+	binary.LittleEndian.PutUint32(data[22:], uint32(0xffffffff-1)) // -2
+	binary.LittleEndian.PutUint16(data[28:], 32)
+	binary.LittleEndian.PutUint32(data[30:], bmpBitfields)
+	copy(data[54:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	decoded, err = decodeBMP(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Could not decode 32 bit image: %s", err)
+	}
+	if got := decoded.At(0, 0).(color.NRGBA); got != (color.NRGBA{3, 2, 1, 4}) {
+		t.Errorf("Top row was wrong: got %v", got)
+	}
+
+	if _, err = decodeBMP(bytes.NewReader([]byte("BM too short"))); err == nil {
+		t.Error("Expected an error decoding a truncated image")
+	}
+
+	// headers claiming far more pixels than there are must not be allocated
+	for _, size := range []uint32{0x7fffffff, 1000} {
+		header := make([]byte, 54+16)
+		copy(header, data[:54])
+		binary.LittleEndian.PutUint32(header[18:], size)
+		binary.LittleEndian.PutUint32(header[22:], size)
+		if _, err = decodeBMP(bytes.NewReader(header)); err == nil {
+			t.Errorf("Expected an error decoding a %dx%d image with no pixels", size, size)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorrupt is wrapped by errors from Store.Load when some records could not be read, but whatever was intact has
+// been returned.
+var ErrCorrupt = errors.New("corrupt history records")
+
+// Store persists clips so that the history survives a restart. Presets are never passed to the store.
+type Store interface {
+	// Load returns every clip in the store, oldest first.
+	Load() ([]Clip, error)
+	// Append records a single new clip.
+	Append(c Clip) error
+	// Rewrite replaces the contents of the store with clips, oldest first.
+	Rewrite(clips []Clip) error
+}
+
+// Persist loads any clips held in s into the history, then records all future clips to it. If the store could only
+// be partially read, the error wraps ErrCorrupt and the store is still used; the intact clips are kept and the
+// corrupt records are dropped by compacting straight away.
+func (h *History) Persist(s Store) error {
+	clips, loadErr := s.Load()
+	if loadErr != nil && !errors.Is(loadErr, ErrCorrupt) {
+		return fmt.Errorf("could not load history: %w", loadErr)
+	}
+
+	h.mu.Lock()
+	clips, missing, err := h.attachBlobs(clips)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// in case they were written before images were described, which can take a while
+	for i := range clips {
+		describeImage(&clips[i])
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if missing > 0 && loadErr == nil {
+		loadErr = fmt.Errorf("%w: the contents of %d clips were missing", ErrCorrupt, missing)
+	}
+
+	for _, c := range clips {
+		if c.ID >= h.nextID {
+			h.nextID = c.ID + 1
+		}
+	}
+	for _, c := range clips {
+		if c.ID == 0 {
+			// written before clips had IDs
+			c.ID = h.newID()
+		}
+		if c.Pinned {
+			h.pinned = append(h.pinned, c)
+			continue
+		}
+		// Replaying through append gives us the same ring (duplicates and all) we had before the restart.
+		h.append(c)
+	}
+	// The presets were numbered before we knew which IDs were taken
+	for i := range h.presets {
+		h.presets[i].ID = h.newID()
+	}
+	h.store = s
+
+	if err := h.compact(); err != nil {
+		return err
+	}
+	return loadErr
+}
+
+// Compact rewrites the store so that it only contains the clips currently in the ring, along with the pinned clips.
+// It does nothing if no clips have been added since the last compaction.
+func (h *History) Compact() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.store == nil || h.dirty == 0 {
+		return nil
+	}
+	return h.compact()
+}
+
+// attachBlobs connects loaded clips to their blobs, and drops any clips whose blobs are missing.
+func (h *History) attachBlobs(clips []Clip) ([]Clip, int, error) {
+	stored := make(map[string]bool)
+	if h.blobs != nil {
+		hashes, err := h.blobs.List()
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not list blobs: %w", err)
+		}
+		for _, hash := range hashes {
+			stored[hash] = true
+		}
+	}
+
+	r := clips[:0]
+	for _, c := range clips {
+		if c.Blob != "" {
+			if !stored[c.Blob] {
+				continue
+			}
+			c.blobs = h.blobs
+		}
+		r = append(r, c)
+	}
+	return r, len(clips) - len(r), nil
+}
+
+// persistAll compacts the store straight away, for changes that can't be recorded by appending a clip. Any blobs
+// released along the way are removed.
+func (h *History) persistAll() error {
+	if h.store == nil {
+		return h.removeOrphans()
+	}
+	return h.compact()
+}
+
+// compact rewrites the store, after which no record refers to the blobs released by clips leaving the history, so
+// they are removed too.
+func (h *History) compact() error {
+	if err := h.store.Rewrite(h.snapshot()); err != nil {
+		return fmt.Errorf("could not compact history: %w", err)
+	}
+	h.dirty = 0
+	return h.removeOrphans()
+}
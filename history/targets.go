@@ -0,0 +1,40 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// OpenTarget returns a reader for the contents of the clip in the named target, and its size. An empty name opens
+// the main contents, as Open does.
+func (c *Clip) OpenTarget(name string) (ClipReader, int, error) {
+	if name == "" {
+		r, err := c.Open()
+		return r, c.Size(), err
+	}
+	data, ok := c.Targets[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("clip has no %s target", name)
+	}
+	return memReader{bytes.NewReader(data)}, len(data), nil
+}
+
+// TargetNames returns the names of the other targets the clip can be pasted as.
+func (c *Clip) TargetNames() []string {
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// totalSize is the size of the clip including its other targets, which is what counts towards the limits.
+func (c *Clip) totalSize() int {
+	n := c.Size()
+	for _, data := range c.Targets {
+		n += len(data)
+	}
+	return n
+}
@@ -0,0 +1,130 @@
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LineData is what a GET line template is executed with, describing one clip.
+type LineData struct {
+	ID         uint64
+	Age        string    // relative time, e.g. "5s ago", or "preset"
+	Time       time.Time // when it was copied, zero for presets
+	Source     string    // the WM_CLASS of the application, e.g. firefox, or unknown
+	Title      string    // of the window it was copied from
+	PID        int       // of the application, or zero
+	Selection  string    // it was copied from, e.g. PRIMARY, or empty for presets
+	Format     string    // e.g. text, html, png
+	Size       int       // in bytes
+	Width      int       // of an image, or zero
+	Height     int       // of an image, or zero
+	ImageHash  string    // perceptual hash of an image in hex, or empty
+	Lines      int       // number of lines of text
+	ExtraLines int       // number of lines after the first
+	Pinned     bool
+	Sensitive  bool
+	Preset     bool
+	Preview    string // the first line of text, or a description of the clip
+}
+
+var templateFuncs = template.FuncMap{
+	"trunc": func(width int, s string) string {
+		if displayWidth(s) <= width {
+			return s
+		}
+		if width < 3 {
+			return truncateWidth(s, width)
+		}
+		return truncateWidth(s, width-3) + "..."
+	},
+	"pad": func(width int, s string) string {
+		return s + strings.Repeat(" ", max0(width-displayWidth(s)))
+	},
+	"lpad": func(width int, s string) string {
+		return strings.Repeat(" ", max0(width-displayWidth(s))) + s
+	},
+	"width": displayWidth,
+	"size":  formatSize,
+}
+
+// TemplateFormatter returns a formatter for GET lines which executes a text/template with the LineData for each clip.
+// Along with the standard functions, templates can use trunc and pad (to a display width, truncating with ... or
+// padding with spaces), lpad, width, and size (to show a number of bytes as e.g. 312kB). For example:
+//
+//	{{if .Pinned}}[pinned]{{else}}[{{.Age}}]{{end}} {{trunc 50 .Preview}}{{if .ExtraLines}} [+{{.ExtraLines}}]{{end}}
+func TemplateFormatter(text string) (func(Clip) string, error) {
+	tmpl, err := template.New("line").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	// catch mistakes such as unknown fields now, rather than on every line
+	sample := Clip{Created: time.Now(), Value: []uint8("sample\nclip"), Format: StringFormat}
+	if err = tmpl.Execute(&bytes.Buffer{}, lineData(sample)); err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+
+	return func(c Clip) string {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, lineData(c)); err != nil {
+			return sanitiseLine(fmt.Sprintf("template error: %s", err))
+		}
+		// each clip must stay on its own line
+		return sanitiseLine(buf.String())
+	}, nil
+}
+
+func lineData(c Clip) LineData {
+	preview, extra := c.describe(lineLen)
+	return LineData{
+		ID:         c.ID,
+		Age:        strings.TrimSpace(getRelativeTimeString(c.Created)),
+		Time:       c.Created,
+		Source:     c.Source,
+		Title:      c.Title,
+		PID:        c.PID,
+		Selection:  c.Selection,
+		Format:     c.Format.String(),
+		Size:       c.Size(),
+		Width:      c.Width,
+		Height:     c.Height,
+		ImageHash:  imageHashString(c),
+		Lines:      extra + 1,
+		ExtraLines: extra,
+		Pinned:     c.Pinned,
+		Sensitive:  c.Sensitive,
+		Preset:     c.Created.IsZero(),
+		Preview:    preview,
+	}
+}
+
+func imageHashString(c Clip) string {
+	if c.Width == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%016x", c.ImageHash)
+}
+
+func (f ClipFormat) String() string {
+	switch f {
+	case StringFormat:
+		return "text"
+	case HtmlFormat:
+		return "html"
+	case FilesFormat:
+		return "files"
+	}
+	if f.IsImage() {
+		return f.imageName()
+	}
+	return "none"
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
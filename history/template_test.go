@@ -0,0 +1,80 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplateFormatter(t *testing.T) {
+	clip := Clip{
+		ID: 7, Created: time.Now().Add(-5 * time.Second), Value: []uint8("日本語 text\nmore\nlines"),
+		Format: StringFormat, Source: "firefox", Title: "Example — Mozilla Firefox", PID: 4242,
+	}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{.ID}} [{{.Age}}] {{.Preview}}", "7 [5s ago] 日本語 text"},
+		{"{{.Source}}/{{.Format}}/{{.Size}}/{{.Lines}}/{{.ExtraLines}}", "firefox/text/25/3/2"},
+		{"{{.Title}} ({{.PID}})", "Example — Mozilla Firefox (4242)"},
+		{"{{trunc 8 .Preview}}|", "日本...|"},
+		{"{{pad 12 .Preview}}|{{lpad 4 .Source}}", "日本語 text |firefox"},
+		{"{{width .Preview}} {{size 2048}}", "11 2kB"},
+		{"{{if .Pinned}}pinned{{else}}{{.Time.Format \"2006\"}}{{end}}", clip.Created.Format("2006")},
+		{"line\n{{.ID}}", "line 7"},
+	}
+
+	for _, tt := range tests {
+		f, err := TemplateFormatter(tt.template)
+		if err != nil {
+			t.Errorf("Could not parse %q: %s", tt.template, err)
+			continue
+		}
+		if got := f(clip); got != tt.expected {
+			t.Errorf("Template %q: got %q expected %q", tt.template, got, tt.expected)
+		}
+	}
+
+	image := Clip{Created: time.Now(), Format: PngFormat, Width: 1920, Height: 1080, ImageHash: 0xbeef}
+	f, _ := TemplateFormatter("{{.Width}}x{{.Height}} {{.ImageHash}}|{{.ImageHash}}")
+	if got := f(image); got != "1920x1080 000000000000beef|000000000000beef" {
+		t.Errorf("Image fields were wrong: got %q", got)
+	}
+	if got := f(clip); got != "0x0 |" {
+		t.Errorf("Image fields should be empty for text: got %q", got)
+	}
+
+	for _, bad := range []string{"{{.ID", "{{.NoSuchField}}", "{{nosuchfunc .ID}}"} {
+		if _, err := TemplateFormatter(bad); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestFindEntryTemplate(t *testing.T) {
+	h := NewHistory(5, []string{"preset"})
+	for _, s := range []string{"first clip", "second clip", "third clip"} {
+		h.Append(newTestClip(s))
+	}
+
+	f, _ := TemplateFormatter("{{.Source}}: {{.Preview}}")
+	lines := h.Format(f)
+	if strings.Join(lines, "|") != "unknown: third clip|unknown: second clip|unknown: first clip|preset: preset" {
+		t.Fatalf("Lines were wrong: got %q", lines)
+	}
+
+	for i, expected := range []string{"third clip", "second clip", "first clip", "preset"} {
+		c, err := h.FindEntry(lines[i] + "\n")
+		if err != nil || string(c.Value) != expected {
+			t.Errorf("Wrong clip for %q: got %v %s", lines[i], c, err)
+		}
+	}
+
+	// lines in the default format are still found, even once something else has been listed
+	line := HistoryFormatter(newTestClip("second clip"))
+	if c, err := h.FindEntry(line); err != nil || string(c.Value) != "second clip" {
+		t.Errorf("Wrong clip for %q: got %v %s", line, c, err)
+	}
+}
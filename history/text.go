@@ -0,0 +1,39 @@
+package history
+
+import (
+	"bytes"
+	"strings"
+)
+
+// IsText reports whether clips in this format can be shown, searched and pasted as plain text.
+func (f ClipFormat) IsText() bool {
+	return f == StringFormat || f == HtmlFormat || f == FilesFormat
+}
+
+// Text returns the contents of the clip as plain text: HTML is stripped of its markup, and file lists are the paths
+// of the files, one per line.
+func (c *Clip) Text() ([]byte, error) {
+	data, err := c.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	switch c.Format {
+	case HtmlFormat:
+		return []byte(HTMLText(data)), nil
+	case FilesFormat:
+		return []byte(strings.Join(parseURIList(data), "\n")), nil
+	}
+	return data, nil
+}
+
+// OpenText is like OpenTarget, but for the clip as plain text, as returned by Text.
+func (c *Clip) OpenText() (ClipReader, int, error) {
+	if c.Format == StringFormat || !c.Format.IsText() {
+		return c.OpenTarget("")
+	}
+	data, err := c.Text()
+	if err != nil {
+		return nil, 0, err
+	}
+	return memReader{bytes.NewReader(data)}, len(data), nil
+}
@@ -0,0 +1,182 @@
+package history
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// wide are the runes which take up two columns in a terminal: East Asian wide and fullwidth characters, and emoji.
+var wide = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2329, Hi: 0x232a, Stride: 1},
+		{Lo: 0x23e9, Hi: 0x23ec, Stride: 1},
+		{Lo: 0x23f0, Hi: 0x23f3, Stride: 3},
+		{Lo: 0x25fd, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2615, Stride: 1},
+		{Lo: 0x2648, Hi: 0x2653, Stride: 1},
+		{Lo: 0x267f, Hi: 0x2693, Stride: 20},
+		{Lo: 0x26a1, Hi: 0x26a1, Stride: 1},
+		{Lo: 0x26aa, Hi: 0x26ab, Stride: 1},
+		{Lo: 0x26bd, Hi: 0x26be, Stride: 1},
+		{Lo: 0x26c4, Hi: 0x26c5, Stride: 1},
+		{Lo: 0x26ce, Hi: 0x26d4, Stride: 6},
+		{Lo: 0x26ea, Hi: 0x26ea, Stride: 1},
+		{Lo: 0x26f2, Hi: 0x26f3, Stride: 1},
+		{Lo: 0x26f5, Hi: 0x26fa, Stride: 5},
+		{Lo: 0x26fd, Hi: 0x2705, Stride: 8},
+		{Lo: 0x270a, Hi: 0x270b, Stride: 1},
+		{Lo: 0x2728, Hi: 0x274c, Stride: 36},
+		{Lo: 0x274e, Hi: 0x274e, Stride: 1},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27b0, Hi: 0x27bf, Stride: 15},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 5},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0x33ff, Stride: 1},
+		{Lo: 0x3400, Hi: 0x4dbf, Stride: 1},
+		{Lo: 0x4e00, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xa960, Hi: 0xa97f, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe10, Hi: 0xfe19, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe6f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x16fe0, Hi: 0x16fe4, Stride: 1},
+		{Lo: 0x17000, Hi: 0x18aff, Stride: 1},
+		{Lo: 0x1b000, Hi: 0x1b2ff, Stride: 1},
+		{Lo: 0x1f004, Hi: 0x1f004, Stride: 1},
+		{Lo: 0x1f0cf, Hi: 0x1f18e, Stride: 191},
+		{Lo: 0x1f191, Hi: 0x1f19a, Stride: 1},
+		{Lo: 0x1f200, Hi: 0x1f251, Stride: 1},
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6ff, Stride: 1},
+		{Lo: 0x1f7e0, Hi: 0x1f7eb, Stride: 1},
+		{Lo: 0x1f90c, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x1fa70, Hi: 0x1faff, Stride: 1},
+		{Lo: 0x20000, Hi: 0x2fffd, Stride: 1},
+		{Lo: 0x30000, Hi: 0x3fffd, Stride: 1},
+	},
+}
+
+const (
+	zwj                 = '\u200d'
+	emojiPresentation   = '\ufe0f' // variation selector 16
+	regionalIndicatorLo = 0x1f1e6
+	regionalIndicatorHi = 0x1f1ff
+	emojiModifierLo     = 0x1f3fb
+	emojiModifierHi     = 0x1f3ff
+)
+
+// runeWidth returns the number of columns r takes up in a terminal, which is zero for combining marks and other
+// invisible runes.
+func runeWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1160 && r <= 0x11ff:
+		// Hangul vowels and final consonants, which join onto the consonant before them
+		return 0
+	case unicode.Is(wide, r):
+		return 2
+	}
+	return 1
+}
+
+// extends reports whether r continues the grapheme cluster ending in prev, roughly following UAX #29. riCount is the
+// number of regional indicators in a row that the cluster ends with.
+func extends(prev, r rune, riCount int) bool {
+	switch {
+	case prev == zwj && isPictographic(r):
+		return true // joined emoji, e.g. families
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc, unicode.Cf):
+		return true
+	case r >= emojiModifierLo && r <= emojiModifierHi:
+		return true // skin tones
+	case r >= regionalIndicatorLo && r <= regionalIndicatorHi:
+		return riCount%2 == 1 // flags are pairs of regional indicators
+	}
+	return false
+}
+
+// isPictographic roughly reports whether r is an emoji, which can be joined onto the one before it.
+func isPictographic(r rune) bool {
+	return (r >= 0x2600 && r <= 0x27bf) || (r >= 0x1f000 && r <= 0x1faff)
+}
+
+// eachGrapheme calls f with each grapheme cluster (what a reader would see as a single character) in s, and the
+// number of columns it takes up. It stops early if f returns false.
+func eachGrapheme(s string, f func(g string, width int) bool) {
+	start, width, riCount := 0, 0, 0
+	var prev, base rune
+	for i, r := range s {
+		if i > 0 && !extends(prev, r, riCount) {
+			if !f(s[start:i], width) {
+				return
+			}
+			start, width, riCount = i, 0, 0
+		}
+		if i == start {
+			base = r
+		}
+
+		switch {
+		case i > start && ((prev == zwj && isPictographic(r)) || (r >= emojiModifierLo && r <= emojiModifierHi)):
+			// part of an emoji that is already counted
+		case r == emojiPresentation && width == 1 && isPictographic(base):
+			width = 2 // a symbol drawn as an emoji
+		case r >= regionalIndicatorLo && r <= regionalIndicatorHi:
+			riCount++
+			width++
+		default:
+			width += runeWidth(r)
+		}
+		prev = r
+	}
+	if start < len(s) {
+		f(s[start:], width)
+	}
+}
+
+// displayWidth returns the number of columns s takes up in a terminal.
+func displayWidth(s string) int {
+	n := 0
+	eachGrapheme(s, func(_ string, width int) bool {
+		n += width
+		return true
+	})
+	return n
+}
+
+// truncateWidth returns the longest prefix of s that is at most width columns wide, without splitting any grapheme
+// clusters.
+func truncateWidth(s string, width int) string {
+	end, n := 0, 0
+	eachGrapheme(s, func(g string, w int) bool {
+		if n+w > width {
+			return false
+		}
+		end += len(g)
+		n += w
+		return true
+	})
+	return s[:end]
+}
+
+// sanitiseLine makes s safe to show on a single line: invalid UTF-8 is replaced, and control characters (including
+// tabs) become spaces.
+func sanitiseLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.ToValidUTF8(s, string(utf8.RuneError)))
+}
@@ -0,0 +1,104 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		in        string
+		width     int
+		graphemes int
+	}{
+		{"hello", 5, 5},
+		{"日本語", 6, 3},
+		{"ｆｕｌｌ", 8, 4},
+		{"e\u0301te\u0301", 3, 3},                            // combining accents
+		{"\U0001f600", 2, 1},                                 // 😀
+		{"\U0001f44d\U0001f3fd", 2, 1},                       // thumbs up with a skin tone
+		{"\U0001f468\u200d\U0001f469\u200d\U0001f467", 2, 1}, // family
+		{"\U0001f1ec\U0001f1e7\U0001f1eb\U0001f1f7", 4, 2},   // two flags
+		{"❤\ufe0f", 2, 1},                                    // heart drawn as an emoji
+		{"한국어", 6, 3},
+		{"a\u200bb", 2, 2}, // zero width space
+	}
+
+	for _, tt := range tests {
+		graphemes := 0
+		eachGrapheme(tt.in, func(string, int) bool {
+			graphemes++
+			return true
+		})
+		if got := displayWidth(tt.in); got != tt.width || graphemes != tt.graphemes {
+			t.Errorf("%q: got width %d and %d graphemes, expected %d and %d", tt.in, got, graphemes, tt.width, tt.graphemes)
+		}
+	}
+}
+
+func TestTruncateWidth(t *testing.T) {
+	tests := []struct {
+		in       string
+		width    int
+		expected string
+	}{
+		{"hello", 3, "hel"},
+		{"日本語", 3, "日"},
+		{"日本語", 4, "日本"},
+		{"cafe\u0301s", 4, "cafe\u0301"},
+		{"\U0001f468\u200d\U0001f469\u200d\U0001f467!", 1, ""},
+		{"\U0001f1ec\U0001f1e7\U0001f1eb\U0001f1f7", 3, "\U0001f1ec\U0001f1e7"},
+	}
+
+	for _, tt := range tests {
+		if got := truncateWidth(tt.in, tt.width); got != tt.expected {
+			t.Errorf("truncateWidth(%q, %d) = %q, expected %q", tt.in, tt.width, got, tt.expected)
+		}
+	}
+}
+
+func TestHistoryFormatUnicode(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{strings.Repeat("日本語", 10), "[ 0s ago] " + strings.Repeat("日本語", 7) + "日本... "},
+		{"tab\tseparated", "[ 0s ago] tab separated" + strings.Repeat(" ", 37)},
+		{strings.Repeat("e\u0301", 60), "[ 0s ago] " + strings.Repeat("e\u0301", 47) + "..."},
+	}
+
+	for _, tt := range tests {
+		if got := HistoryFormatter(newTestClip(tt.in)); got != tt.expected {
+			t.Errorf("Format was wrong, expected %q got %q", tt.expected, got)
+		}
+	}
+}
+
+func FuzzHistoryFormatter(f *testing.F) {
+	for _, s := range []string{
+		"hello", "multiple\nlines", strings.Repeat("日本語", 30), "e\u0301\u0301\u0301",
+		"\U0001f468\u200d\U0001f469\u200d\U0001f467 family", "\U0001f1ec\U0001f1e7", "\xff\xfe invalid",
+		"tab\there\r\n", "\u200d\ufe0f", "각",
+	} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		c := Clip{Created: time.Now(), Value: []uint8(s), Format: StringFormat}
+		got := HistoryFormatter(c)
+		if !utf8.ValidString(got) {
+			t.Fatalf("Invalid UTF-8 for %q: %q", s, got)
+		}
+		if w := displayWidth(got); w != lineLen {
+			t.Fatalf("Wrong width for %q: got %d, %q", s, w, got)
+		}
+		for _, r := range got {
+			if unicode.IsControl(r) {
+				t.Fatalf("Control character in output for %q: %q", s, got)
+			}
+		}
+	})
+}
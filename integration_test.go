@@ -46,7 +46,7 @@ func TestClipClopIntegration(t *testing.T) {
 		{"clipboard", "blaa"}, // just long enough, will be included
 		{"clipboard", "hello world"},
 		{"clipboard", "wee %*21"},
-		{"primary", "we ignore primary selections, now"},
+		{"primary", "primary selections are ignored by default"},
 		{"clipboard", "awkrwere\nwrir rwerr jwer "},
 	}
 
@@ -109,12 +109,60 @@ func TestClipClopClipboardOwnership(t *testing.T) {
 	}
 	populateClips(clips)
 
-	fullClip, _ := getSelWithXclip()
+	fullClip, _ := getSelWithXclip("primary")
 	if fullClip != "third world" {
 		t.Fatalf("Should have pasted the last copied entry, but got %s", fullClip)
 	}
 }
 
+func TestClipClopPrimary(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	opts := opts
+	opts.Selections = "clipboard,primary"
+	opts.PrimaryDelay = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // cleanup when test is done
+
+	go run(ctx, logger, opts)
+
+	// primary is only captured once it has settled, so give it time before copying anything else
+	populateClips([][]string{{"primary", "selected with the mouse"}})
+	populateClips([][]string{{"clipboard", "copied as usual"}})
+
+	lines := checkGET(t, 2)
+	if !strings.HasPrefix(lines[0], "[ 1s ago] copied as usual") {
+		t.Fatalf("Expected the clipboard to be captured last, got %s", lines)
+	}
+	checkSEL(t, lines[1], "selected with the mouse")
+}
+
+func TestClipClopSync(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	opts := opts
+	opts.Selections = "clipboard,primary"
+	opts.PrimaryDelay = 100 * time.Millisecond
+	opts.Sync = "both"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // cleanup when test is done
+
+	go run(ctx, logger, opts)
+
+	populateClips([][]string{{"primary", "selected with the mouse"}})
+	if fullClip, _ := getSelWithXclip("clipboard"); fullClip != "selected with the mouse" {
+		t.Fatalf("Should have pasted the primary selection from the clipboard, but got %s", fullClip)
+	}
+
+	populateClips([][]string{{"clipboard", "copied as usual"}})
+	if fullClip, _ := getSelWithXclip("primary"); fullClip != "copied as usual" {
+		t.Fatalf("Should have pasted the clipboard as the primary selection, but got %s", fullClip)
+	}
+
+	// taking the selections didn't capture the clips again
+	checkGET(t, 2)
+}
+
 func TestClipClopINCR(t *testing.T) {
 	logger := log.New(io.Discard, "", 0)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -153,7 +201,7 @@ func checkSEL(t *testing.T, line string, expected string) {
 		t.Fatalf("Could not set clip %s: %s, err: %s", line, out, err)
 	}
 
-	fullClip, err := getSelWithXclip()
+	fullClip, err := getSelWithXclip("primary")
 	if err != nil {
 		t.Fatalf("Could not get selection after SEL %s", line)
 	}
@@ -224,8 +272,8 @@ func setSelWithXclip(val string, sel string) error {
 	return cmd.Run()
 }
 
-func getSelWithXclip() (string, error) {
-	cmd := exec.Command("xclip", "-o", "-selection", "primary")
+func getSelWithXclip(sel string) (string, error) {
+	cmd := exec.Command("xclip", "-o", "-selection", sel)
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
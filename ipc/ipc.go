@@ -1,18 +1,30 @@
 package ipc
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/maxjmax/clipclop/history"
 	"github.com/maxjmax/clipclop/x"
 )
 
-func IPCServer(ctx context.Context, logger *log.Logger, hist *history.History, xconn *x.X, sock string) {
+// maxCommandLen is the longest command we will read.
+const maxCommandLen = 1 << 20
+
+// IPCServer answers commands on the unix socket sock. GET and FIND format each clip with formatter. Commands use the
+// history of the selection given with -selection, or the main history.
+func IPCServer(ctx context.Context, logger *log.Logger, hists *history.Histories, xconn *x.X, sock string, formatter func(history.Clip) string) {
 	if err := os.RemoveAll(sock); err != nil {
 		logger.Fatalf("could not remove IPC socket file %s", sock)
 	}
@@ -38,25 +50,20 @@ func IPCServer(ctx context.Context, logger *log.Logger, hist *history.History, x
 			return
 		}
 
-		err = handleConnection(conn, hist, xconn)
+		err = handleConnection(conn, hists, xconn, formatter)
 		if err != nil {
 			logger.Printf("error handling connection: %s", err)
 		}
 	}
 }
 
-func handleConnection(conn net.Conn, hist *history.History, xconn *x.X) error {
+func handleConnection(conn net.Conn, hists *history.Histories, xconn *x.X, formatter func(history.Clip) string) error {
 	defer conn.Close()
-	buff := make([]byte, 256)
-	_, err := conn.Read(buff)
+	cmd, err := readCommand(conn)
 	if err != nil {
-		return fmt.Errorf("could not read from connection: %w", err)
-	}
-	nl := strings.IndexRune(string(buff), '\n')
-	if nl < 0 {
-		return fmt.Errorf("did not find newline in command: %w", err)
+		return err
 	}
-	output := handleCommand(string(buff)[:nl], hist, xconn)
+	output := handleCommand(cmd, hists, xconn, formatter)
 	_, err = conn.Write([]byte(output))
 	if err != nil {
 		return fmt.Errorf("could not write output: %w", err)
@@ -65,28 +72,153 @@ func handleConnection(conn net.Conn, hist *history.History, xconn *x.X) error {
 	return nil
 }
 
-func handleCommand(cmd string, hist *history.History, xconn *x.X) string {
+// readCommand reads a command up to its newline. Commands can carry a whole line of a listing, which can be as long
+// as a template makes it, so they are only cut off at maxCommandLen.
+func readCommand(r io.Reader) (string, error) {
+	cmd, err := bufio.NewReader(io.LimitReader(r, maxCommandLen)).ReadString('\n')
+	if err == io.EOF {
+		return "", errors.New("did not find newline in command")
+	} else if err != nil {
+		return "", fmt.Errorf("could not read from connection: %w", err)
+	}
+	return strings.TrimSuffix(cmd, "\n"), nil
+}
+
+func handleCommand(cmd string, hists *history.Histories, xconn *x.X, formatter func(history.Clip) string) string {
 	// TODO: don't like passing the history dowm, needs refactoring
 	// TODO: we could wrap it in an IPCServer object, not convinced that's _better_ though.
-	if len(cmd) < 3 {
-		return "ERR Invalid command" // commands are 3 characters
-	}
-	switch cmd[:3] {
-	case "GET":
-		return strings.Join(hist.Format(history.HistoryFormatter), "\n") + "\n"
+	name, args, _ := strings.Cut(cmd, " ")
+	switch name {
+	case "GET", "FIND":
+		opts, err := parseListArgs(name, args)
+		if err != nil {
+			return fmt.Sprintf("ERR Invalid arguments: %s", err)
+		}
+
+		if opts.withID {
+			formatter = history.WithID(formatter)
+		}
+		hist := hists.For(opts.filter.Selection)
+		var lines []string
+		if name == "FIND" {
+			lines = hist.Find(opts.query, opts.filter, formatter)
+		} else {
+			lines = hist.FormatMatching(formatter, opts.filter)
+		}
+		if opts.limit > 0 && len(lines) > opts.limit {
+			lines = lines[:opts.limit]
+		}
+		return strings.Join(lines, "\n") + "\n"
 	case "SEL":
-		clip, err := hist.FindEntry(cmd[3:])
+		selection, args := cutSelection(args)
+		hist := hists.For(selection)
+		clip, err := findClip(hist, args)
 		if err != nil {
 			return fmt.Sprintf("ERR Not found: %s", err)
 		}
 
-		hist.SetSelected(clip)
+		hists.SetSelected(hist, clip)
 		err = xconn.BecomeSelectionOwner()
 		if err != nil {
 			return fmt.Sprintf("ERR Could not become owner: %s", err)
 		}
 		return "OK"
+	case "PIN", "UNPIN":
+		selection, args := cutSelection(args)
+		hist := hists.For(selection)
+		clip, err := findClip(hist, args)
+		if err != nil {
+			return fmt.Sprintf("ERR Not found: %s", err)
+		}
+
+		if name == "PIN" {
+			err = hist.Pin(clip.ID)
+		} else {
+			err = hist.Unpin(clip.ID)
+		}
+		if err != nil {
+			return fmt.Sprintf("ERR Could not %s: %s", strings.ToLower(name), err)
+		}
+		return "OK"
 	default:
 		return "ERR Unknown command"
 	}
 }
+
+type listOptions struct {
+	withID bool
+	limit  int
+	filter history.Filter
+	query  string // any arguments after the flags
+}
+
+// parseListArgs parses the flags shared by GET and FIND. A regular expression can't contain spaces, use \s instead.
+func parseListArgs(name string, args string) (listOptions, error) {
+	var opts listOptions
+	var pattern, format string
+	var since time.Duration
+
+	fs := newFlagSet(name)
+	fs.BoolVar(&opts.withID, "id", false, "prefix each line with the clip ID")
+	fs.IntVar(&opts.limit, "n", 0, "maximum number of clips to list")
+	fs.StringVar(&pattern, "re", "", "regular expression to match against the contents of text clips")
+	fs.StringVar(&format, "format", "", "only list clips in this format: text, html, image or files")
+	fs.StringVar(&opts.filter.Source, "source", "", "only list clips copied from this application, by its WM_CLASS (e.g. firefox)")
+	fs.StringVar(&opts.filter.Selection, "selection", "", "only list clips copied from this selection: clipboard, primary or secondary")
+	fs.DurationVar(&since, "since", 0, "only list clips copied within this time")
+	if err := fs.Parse(strings.Fields(args)); err != nil {
+		return opts, err
+	}
+	opts.query = strings.Join(fs.Args(), " ")
+
+	var err error
+	if pattern != "" {
+		if opts.filter.Pattern, err = regexp.Compile(pattern); err != nil {
+			return opts, err
+		}
+	}
+	if format != "" {
+		if opts.filter.Formats, err = history.FormatsByName(format); err != nil {
+			return opts, err
+		}
+	}
+	if since > 0 {
+		opts.filter.Since = time.Now().Add(-since)
+	}
+	return opts, nil
+}
+
+// cutSelection splits a -selection qualifier (e.g. -selection primary) from the start of the arguments to SEL, PIN and
+// UNPIN, returning the selection and the rest of the arguments.
+func cutSelection(args string) (string, string) {
+	rest := strings.TrimLeft(args, " ")
+	if !strings.HasPrefix(rest, "-selection ") {
+		return "", args
+	}
+	selection, rest, _ := strings.Cut(strings.TrimLeft(strings.TrimPrefix(rest, "-selection "), " "), " ")
+	return selection, rest
+}
+
+// findClip finds the clip for a line returned by GET, or by its ID: either a GET -id line, or a bare ID. A bare ID is
+// only tried once no line matches, as a template may well make a line that is just a number.
+func findClip(hist *history.History, sel string) (*history.Clip, error) {
+	if field, _, ok := strings.Cut(sel, "\t"); ok {
+		if id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 64); err == nil {
+			return hist.FindByID(id)
+		}
+	}
+	clip, err := hist.FindEntry(sel)
+	if err == nil {
+		return clip, nil
+	}
+	if id, perr := strconv.ParseUint(strings.TrimSpace(sel), 10, 64); perr == nil {
+		return hist.FindByID(id)
+	}
+	return nil, err
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
@@ -0,0 +1,148 @@
+package ipc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxjmax/clipclop/history"
+)
+
+func TestParseListArgs(t *testing.T) {
+	tests := []struct {
+		args      string
+		withID    bool
+		limit     int
+		pattern   string
+		formats   []history.ClipFormat
+		source    string
+		selection string
+		since     bool
+		query     string
+		err       bool
+	}{
+		{args: ""},
+		{args: "-id -n 5", withID: true, limit: 5},
+		{args: `-re ^https?://\S+`, pattern: `^https?://\S+`},
+		{args: "-format image", formats: history.ImageFormats},
+		{args: "-format text -source firefox", formats: []history.ClipFormat{history.StringFormat, history.HtmlFormat}, source: "firefox"},
+		{args: "-selection primary -since 1h", selection: "primary", since: true},
+		{args: "-n 3 some fuzzy query", limit: 3, query: "some fuzzy query"},
+		{args: "query -id", query: "query -id"},
+		{args: "-format video", err: true},
+		{args: "-re (", err: true},
+		{args: "-since yesterday", err: true},
+		{args: "-nope", err: true},
+	}
+
+	for _, tt := range tests {
+		opts, err := parseListArgs("GET", tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseListArgs(%q): expected an error", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseListArgs(%q): unexpected error %s", tt.args, err)
+			continue
+		}
+
+		pattern := ""
+		if opts.filter.Pattern != nil {
+			pattern = opts.filter.Pattern.String()
+		}
+		if opts.withID != tt.withID || opts.limit != tt.limit || pattern != tt.pattern ||
+			!reflect.DeepEqual(opts.filter.Formats, tt.formats) || opts.filter.Source != tt.source ||
+			opts.filter.Selection != tt.selection || opts.query != tt.query {
+			t.Errorf("parseListArgs(%q): got %+v", tt.args, opts)
+		}
+		if since := !opts.filter.Since.IsZero(); since != tt.since {
+			t.Errorf("parseListArgs(%q): got since %s", tt.args, opts.filter.Since)
+		} else if since && time.Since(opts.filter.Since) < 59*time.Minute {
+			t.Errorf("parseListArgs(%q): since should be an hour ago, got %s", tt.args, opts.filter.Since)
+		}
+	}
+}
+
+func TestCutSelection(t *testing.T) {
+	tests := []struct {
+		args      string
+		selection string
+		rest      string
+	}{
+		{"[ 5s ago] hello", "", "[ 5s ago] hello"},
+		{"-selection primary [ 5s ago] hello", "primary", "[ 5s ago] hello"},
+		{"  -selection  primary 3", "primary", "3"},
+		{"-selectionprimary 3", "", "-selectionprimary 3"},
+	}
+	for _, tt := range tests {
+		selection, rest := cutSelection(tt.args)
+		if selection != tt.selection || rest != tt.rest {
+			t.Errorf("cutSelection(%q): got %q, %q expected %q, %q", tt.args, selection, rest, tt.selection, tt.rest)
+		}
+	}
+}
+
+func TestFindClip(t *testing.T) {
+	h := history.NewHistory(10, nil)
+	start := time.Now().Add(-time.Hour)
+	for i, v := range []string{"first clip", "1", "third clip"} {
+		h.Append(history.Clip{Created: start.Add(time.Duration(i) * time.Minute), Value: []uint8(v), Format: history.StringFormat})
+	}
+	preview := func(c history.Clip) string { return string(c.Value) }
+	h.Format(preview)
+
+	tests := []struct {
+		sel      string
+		expected string
+	}{
+		{"third clip", "third clip"},
+		{"1", "1"},                    // a listed line, before an ID
+		{"3", "third clip"},           // a bare ID, as no line matches
+		{"1\tanything", "first clip"}, // a GET -id line
+		{" 2\t", "1"},
+	}
+	for _, tt := range tests {
+		c, err := findClip(h, tt.sel)
+		if err != nil {
+			t.Errorf("findClip(%q): unexpected error %s", tt.sel, err)
+		} else if string(c.Value) != tt.expected {
+			t.Errorf("findClip(%q): got %q expected %q", tt.sel, c.Value, tt.expected)
+		}
+	}
+
+	for _, sel := range []string{"no such clip", "42", "42\tthird clip"} {
+		if c, err := findClip(h, sel); err == nil {
+			t.Errorf("findClip(%q): expected an error, got %q", sel, c.Value)
+		}
+	}
+
+	// lines from an older listing in the default format are still found
+	line := history.HistoryFormatter(*h.Top())
+	if c, err := findClip(h, line); err != nil || string(c.Value) != "third clip" {
+		t.Errorf("findClip(%q): got %v, %v", line, c, err)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	long := "SEL " + strings.Repeat("a long line from a template ", 50)
+	tests := []struct {
+		input    string
+		expected string
+		err      bool
+	}{
+		{"GET\n", "GET", false},
+		{"GET -n 5\nignored", "GET -n 5", false},
+		{long + "\n", long, false},
+		{"GET", "", true},
+		{strings.Repeat("x", maxCommandLen) + "\n", "", true},
+	}
+	for _, tt := range tests {
+		got, err := readCommand(strings.NewReader(tt.input))
+		if (err != nil) != tt.err || got != tt.expected {
+			t.Errorf("readCommand(%.20q): got %.20q, %v expected %.20q", tt.input, got, err, tt.expected)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/xgb"
@@ -15,6 +20,8 @@ import (
 	"github.com/BurntSushi/xgb/xproto"
 	"github.com/maxjmax/clipclop/history"
 	"github.com/maxjmax/clipclop/ipc"
+	"github.com/maxjmax/clipclop/rules"
+	"github.com/maxjmax/clipclop/store"
 	"github.com/maxjmax/clipclop/x"
 )
 
@@ -24,7 +31,8 @@ func usage() {
 		`Usage: clipclip [ARGUMENTS]
 
 clipclop is a clipboard management daemon. It listens for changes to the X 
-selection and stores them in a ring buffer. Selections are not persisted to disk
+selection and stores them in a ring buffer. The history is persisted to disk, and
+restored when clipclop restarts. Use -keyfile or -passphrase-fd to encrypt it.
 	
 Arguments:
 `)
@@ -35,10 +43,52 @@ Arguments:
 You can interact with clipclop using the specified unix socket.
 The available commands are:
 
-  GET        Get a \n separated list of clips, prefixed with their relative
+  GET [OPTIONS]
+             Get a \n separated list of clips, prefixed with their relative
              time. This is formatted to be fed to dmenu or equivalent.
+             Options:
+               -id        Start each line with the clip ID and a tab, which
+                          can be hidden with e.g. fzf -d '\t' --with-nth 2..
+               -n N       List at most N clips
+               -re REGEX  Only text clips matching REGEX (use \s for spaces)
+               -format F  Only clips in format F: text (including html),
+                          html, image or files
+               -source S  Only clips copied from the application S, by
+                          its WM_CLASS (e.g. firefox)
+               -since D   Only clips copied within duration D, e.g. 2h
+               -selection S
+                          Only clips copied from selection S (clipboard,
+                          primary or secondary), from its own history
+                          with -separate-histories
+  FIND [OPTIONS] [query]
+             As GET, but only the clips whose full contents fuzzy match the
+             query, best match first.
   SEL [clip] Retrieve the raw clip corresponding to the chosen line (as 
-             returned by dmenu or equivalent)
+             returned by dmenu or equivalent), or the clip ID (as returned
+             by GET -id). Start with -selection S to choose it from the
+             history of selection S, as listed by GET -selection S
+  PIN [clip] Pin a clip (chosen as for SEL) so that it is never dropped from
+             the history. Pinned clips are listed after the history.
+  UNPIN [clip]
+             Return a pinned clip to the top of the history
+
+The lines returned by GET and FIND can be changed with -template, which has
+the fields .ID .Age .Time .Source (the application's WM_CLASS) .Title .PID
+.Selection (e.g. PRIMARY) .Format .Size .Width .Height .ImageHash (a
+perceptual hash, to tell images apart) .Lines .ExtraLines .Pinned .Sensitive
+.Preset and .Preview, and the functions trunc N, pad N and lpad N (to a
+display width), width, and size (e.g. 312kB), e.g.
+
+  -template '{{pad 8 .Age}} {{trunc 60 .Preview}}{{if .Pinned}} *{{end}}'
+
+App rules in the rules file decide what happens to clips copied from an
+application, by its WM_CLASS, window title or selection. The first matching
+rule is used, e.g.
+
+  app  ignore   keepassxc  class=(?i)^keepassxc$
+  app  ignore   private    title=(?i)private\sbrowsing
+  app  ignore   terminal   class=(?i)alacritty selection=primary
+  app  capture  editor     class=(?i)^code$ min-size=20
 
 For an example of how to use this with dmenu, see clip.sh in the clipclop repo.
 
@@ -59,12 +109,70 @@ func (a *flagArray) Set(value string) error {
 	return nil
 }
 
+// byteSize is a flag holding a number of bytes, optionally with a kB, MB or GB suffix.
+type byteSize int
+
+func (b *byteSize) String() string {
+	return strconv.Itoa(int(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	n, err := parseByteSize(value)
+	*b = byteSize(n)
+	return err
+}
+
+func parseByteSize(s string) (int, error) {
+	units := []struct {
+		suffix string
+		mult   int
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := 1
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int(n * float64(mult)), nil
+}
+
 type options struct {
-	Sock        string
-	HistorySize int
-	Debug       bool
-	MinClipSize int
-	Presets     flagArray
+	Sock            string
+	HistorySize     int
+	Debug           bool
+	MinClipSize     int
+	Presets         flagArray
+	HistoryFile     string
+	CompactInterval time.Duration
+	KeyFile         string
+	PassphraseFD    int
+	Dedup           bool
+	DedupPolicy     string
+	DedupWindow     time.Duration
+	MaxBytes        byteSize
+	MaxFormatBytes  flagArray
+	BlobDir         string
+	BlobThreshold   byteSize
+	MaxAge          time.Duration
+	SensitiveTTL    time.Duration
+	SecretTargets   flagArray
+	SecretMode      string
+	Targets         flagArray
+	RulesFile       string
+	Template        string
+	Selections      string
+	PrimaryDelay    time.Duration
+	Sync            string
+
+	SeparateHistories    bool
+	SelectionHistorySize int
 }
 
 func main() {
@@ -73,12 +181,49 @@ func main() {
 	flag.StringVar(&opts.Sock, "socket", "/tmp/clipclop.sock", "location of the socket file")
 	flag.IntVar(&opts.HistorySize, "n", 100, "Number of records to keep in history")
 	flag.BoolVar(&opts.Debug, "v", false, "Print verbose debugging output")
-	flag.IntVar(&opts.MinClipSize, "m", 4, "Min clip size. Smaller clips will be discarded.")
+	flag.IntVar(&opts.MinClipSize, "m", 4, "Min clip size. Smaller clips will be discarded, unless an app rule in the rules file sets another min-size.")
+	flag.BoolVar(&opts.Dedup, "dedup", false, "Remove older copies of a clip from anywhere in the history, so that copying it again moves it to the top")
+	flag.StringVar(&opts.DedupPolicy, "dedup-policy", "substring", "How to spot duplicates: substring, exact, prefix, whitespace or none")
+	flag.DurationVar(&opts.DedupWindow, "dedup-window", history.DefaultDedupWindow, "A clip can only replace the previous one if it is copied within this time of it. 0 for no limit.")
+	flag.Var(&opts.MaxBytes, "max-bytes", "Maximum total size of the history, e.g. 100MB. The oldest clips are dropped to stay under it.")
+	flag.Var(&opts.MaxFormatBytes, "max-format-bytes", "Maximum total size of the clips of one kind (text, html, image or files), as KIND=SIZE, e.g. image=50MB. Can be repeated.")
+	flag.StringVar(&opts.BlobDir, "blob-dir", defaultBlobDir(), "Directory to store the contents of large clips in, rather than memory, if the history is persisted. Set to an empty string to keep everything in memory.")
+	opts.BlobThreshold = 512 * 1024
+	flag.Var(&opts.BlobThreshold, "blob-threshold", "Clips larger than this are stored in the blob directory")
+	flag.DurationVar(&opts.MaxAge, "max-age", 0, "Drop clips once they are older than this, e.g. 168h. 0 to keep them until they are pushed out.")
+	flag.DurationVar(&opts.SensitiveTTL, "sensitive-ttl", 30*time.Second, "Drop sensitive clips, such as passwords, once they are older than this. They are never written to disk.")
+	flag.Var(&opts.SecretTargets, "secret-target", "A target that password managers offer to mark a clip as secret. Can be repeated. Defaults to "+strings.Join(x.DefaultSecretTargets, ", "))
+	flag.StringVar(&opts.SecretMode, "secret-mode", "skip", "What to do with clips marked as secret: skip them, or keep them as sensitive clips which expire after the sensitive TTL")
+	flag.Var(&opts.Targets, "target", "A target to keep alongside the main one when a clip is offered in it, so that it can be pasted with its formatting. Can be repeated. Defaults to "+strings.Join(x.DefaultTargets, ", "))
+	flag.StringVar(&opts.RulesFile, "rules-file", defaultRulesFile(), "File of rules to drop, mask or mark as sensitive text and HTML clips matching regular expressions, and to capture, ignore or mark as sensitive clips from applications. Reloaded on SIGHUP. If it doesn't exist, the built-in rules are used.")
+	flag.StringVar(&opts.Template, "template", "", "A text/template for each line returned by GET and FIND, e.g. '{{.Age}} {{.Source}}: {{trunc 50 .Preview}}'. See below for the fields.")
+	flag.StringVar(&opts.Selections, "selections", "clipboard", "The selections to capture, separated by commas: clipboard, primary and secondary")
+	flag.DurationVar(&opts.PrimaryDelay, "primary-delay", 300*time.Millisecond, "Only capture the primary selection once it has been left alone for this long, and the mouse is released, so that a selection being dragged out isn't captured in parts. 0 to capture it straight away.")
+	flag.StringVar(&opts.Sync, "sync", "to-primary", "Which selections a captured clip is also served as: to-primary (a clip copied to the clipboard can be pasted as the primary selection too), to-clipboard (a captured primary selection can be pasted from the clipboard, with -selections primary), both, or none")
+	flag.BoolVar(&opts.SeparateHistories, "separate-histories", false, "Keep the clips from the primary and secondary selections in histories of their own, rather than with the clipboard's. They are only kept in memory.")
+	flag.IntVar(&opts.SelectionHistorySize, "selection-n", 20, "Number of records to keep in the primary and secondary selections' histories, with -separate-histories")
 	flag.Var(&opts.Presets, "preset", "One or more preset strings that will always be included in the history. They will not count towards the history size.")
+	flag.StringVar(&opts.HistoryFile, "history-file", defaultHistoryFile(), "File to persist the history to. Set to an empty string to disable persistence.")
+	flag.DurationVar(&opts.CompactInterval, "compact-interval", 10*time.Minute, "How often to compact the history file")
+	flag.StringVar(&opts.KeyFile, "keyfile", "", "Encrypt the history file with a key derived from the contents of this file")
+	flag.IntVar(&opts.PassphraseFD, "passphrase-fd", -1, "Encrypt the history file with a passphrase read from this file descriptor")
 
 	flag.Parse()
 	logger := log.New(os.Stdout, "", log.Lshortfile|log.Ldate|log.Ltime)
 
+	if opts.SecretMode != "skip" && opts.SecretMode != "sensitive" {
+		logger.Fatalf("Invalid secret mode %q, expected skip or sensitive", opts.SecretMode)
+	}
+	if opts.Sync != "none" && opts.Sync != "to-primary" && opts.Sync != "to-clipboard" && opts.Sync != "both" {
+		logger.Fatalf("Invalid sync mode %q, expected to-primary, to-clipboard, both or none", opts.Sync)
+	}
+	if len(opts.SecretTargets) == 0 {
+		opts.SecretTargets = x.DefaultSecretTargets
+	}
+	if len(opts.Targets) == 0 {
+		opts.Targets = x.DefaultTargets
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
@@ -86,24 +231,300 @@ func main() {
 }
 
 func run(ctx context.Context, logger *log.Logger, opts options) {
-	var err error
-	hist := history.NewHistory(opts.HistorySize, []string(opts.Presets))
+	selections, err := parseSelections(opts.Selections)
+	if err != nil {
+		logger.Fatalf("Invalid selections: %s", err)
+	}
+	hists := setupHistories(ctx, logger, opts, selections)
+
+	rs, err := rules.NewSet(opts.RulesFile)
+	if err != nil {
+		logger.Fatalf("Error loading rules: %s", err)
+	}
+	go reloadRules(ctx, logger, rs)
+
 	xconn, err := x.StartX()
 	if err != nil {
 		logger.Fatalf("Error starting X: %s", err)
 	}
 
-	err = xconn.CreateEventWindow()
+	xconn.SetPrimaryDelay(opts.PrimaryDelay)
+	err = xconn.CreateEventWindow(selections)
 	if err != nil {
 		logger.Fatalf("Error creating event window: %s", err)
 	}
+	if err = xconn.SetSecretTargets(opts.SecretTargets); err != nil {
+		logger.Fatalf("Error setting secret targets: %s", err)
+	}
+	if err = xconn.SetTargets(opts.Targets); err != nil {
+		logger.Fatalf("Error setting targets: %s", err)
+	}
 	logger.Print("Listening for X events")
 
-	go ipc.IPCServer(ctx, logger, hist, xconn, opts.Sock)
-	processEvents(ctx, logger, hist, xconn, opts)
+	formatter := history.HistoryFormatter
+	if opts.Template != "" {
+		if formatter, err = history.TemplateFormatter(opts.Template); err != nil {
+			logger.Fatalf("Error parsing template: %s", err)
+		}
+	}
+
+	go ipc.IPCServer(ctx, logger, hists, xconn, opts.Sock, formatter)
+	go expireClips(ctx, logger, hists, xconn, opts)
+	processEvents(ctx, logger, hists, xconn, rs, opts)
+}
+
+// parseSelections parses a list of selection names separated by commas, e.g. clipboard,primary, into the names of their
+// atoms. CLIPBOARD is the default.
+func parseSelections(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return []string{"CLIPBOARD"}, nil
+	}
+
+	var selections []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		switch name {
+		case "CLIPBOARD", "PRIMARY", "SECONDARY":
+			selections = append(selections, name)
+		default:
+			return nil, fmt.Errorf("unknown selection %q, expected clipboard, primary or secondary", strings.ToLower(name))
+		}
+	}
+	return selections, nil
+}
+
+// setupHistories sets up the main history, and a separate one for each selection other than CLIPBOARD if the
+// histories are to be kept separate. Those are smaller, and only kept in memory.
+func setupHistories(ctx context.Context, logger *log.Logger, opts options, selections []string) *history.Histories {
+	hists := history.NewHistories(setupHistory(ctx, logger, opts))
+	if !opts.SeparateHistories {
+		return hists
+	}
+
+	for _, sel := range selections {
+		if sel == "CLIPBOARD" {
+			continue
+		}
+		selOpts := opts
+		selOpts.HistorySize, selOpts.Presets = opts.SelectionHistorySize, nil
+		selOpts.HistoryFile, selOpts.BlobDir = "", ""
+		hists.Separate(sel, setupHistory(ctx, logger, selOpts))
+	}
+	return hists
+}
+
+// syncedSelections returns the selections to take after capturing a clip from selection, so that it is pasted from
+// them, according to the sync mode. We never take PRIMARY from whatever it was just captured from, as that would
+// unhighlight what was selected.
+func syncedSelections(mode, selection string) []string {
+	switch selection {
+	case "CLIPBOARD":
+		if mode == "none" || mode == "to-clipboard" {
+			return []string{"CLIPBOARD"}
+		}
+		return []string{"CLIPBOARD", "PRIMARY"}
+	case "PRIMARY":
+		if mode == "to-clipboard" || mode == "both" {
+			return []string{"CLIPBOARD"}
+		}
+	}
+	return nil
+}
+
+func setupHistory(ctx context.Context, logger *log.Logger, opts options) *history.History {
+	hist := history.NewHistory(opts.HistorySize, []string(opts.Presets))
+	if opts.DedupPolicy != "" {
+		policy, err := history.NewDedupPolicy(opts.DedupPolicy, opts.DedupWindow)
+		if err != nil {
+			logger.Fatalf("Invalid dedup policy: %s", err)
+		}
+		hist.SetDedupPolicy(policy)
+	}
+	hist.SetDedup(opts.Dedup)
+
+	limits, err := parseLimits(opts)
+	if err != nil {
+		logger.Fatalf("Invalid limits: %s", err)
+	}
+	hist.SetLimits(limits)
+	hist.SetExpiry(opts.MaxAge, opts.SensitiveTTL)
+
+	encrypted := opts.KeyFile != "" || opts.PassphraseFD >= 0
+	switch {
+	case opts.BlobDir == "" || opts.HistoryFile == "":
+		// without persistence, nothing should be left on disk
+	case encrypted:
+		// blobs are served straight from disk, so can't be encrypted
+		logger.Print("Not storing large clips as blobs, as the history is encrypted")
+	default:
+		blobs, err := store.NewBlobDir(opts.BlobDir)
+		if err != nil {
+			logger.Fatalf("Error opening blob directory: %s", err)
+		}
+		hist.SetBlobs(blobs, int(opts.BlobThreshold))
+	}
+
+	if opts.HistoryFile != "" {
+		s, err := openStore(opts)
+		if err != nil {
+			logger.Fatalf("Error opening history file: %s", err)
+		}
+		err = hist.Persist(s)
+		if errors.Is(err, history.ErrCorrupt) {
+			logger.Printf("Recovered history from %s with errors: %s", opts.HistoryFile, err)
+		} else if err != nil {
+			logger.Fatalf("Error loading history: %s", err)
+		}
+		go compactHistory(ctx, logger, hist, opts.CompactInterval)
+	}
+
+	if err = hist.CollectBlobs(); err != nil {
+		logger.Printf("Failed to clean up blobs: %s", err)
+	}
+	return hist
 }
 
-func processEvents(ctx context.Context, logger *log.Logger, hist *history.History, xconn *x.X, opts options) {
+func parseLimits(opts options) (history.Limits, error) {
+	limits := history.Limits{MaxBytes: int(opts.MaxBytes)}
+	for _, l := range opts.MaxFormatBytes {
+		name, size, ok := strings.Cut(l, "=")
+		if !ok {
+			return limits, fmt.Errorf("expected FORMAT=SIZE, got %q", l)
+		}
+		formats, err := history.FormatsByName(name)
+		if err != nil {
+			return limits, err
+		}
+		n, err := parseByteSize(size)
+		if err != nil {
+			return limits, err
+		}
+		// the formats share the limit, so image=50MB is 50MB of images whatever their format
+		limits.MaxFormatBytes = append(limits.MaxFormatBytes, history.FormatLimit{Formats: formats, MaxBytes: n})
+	}
+	return limits, nil
+}
+
+func openStore(opts options) (history.Store, error) {
+	var secret []byte
+	var err error
+	if opts.KeyFile != "" {
+		secret, err = os.ReadFile(opts.KeyFile)
+	} else if opts.PassphraseFD >= 0 {
+		f := os.NewFile(uintptr(opts.PassphraseFD), "passphrase")
+		if f == nil {
+			return nil, fmt.Errorf("invalid passphrase fd %d", opts.PassphraseFD)
+		}
+		secret, err = io.ReadAll(f)
+		f.Close()
+		secret = bytes.TrimRight(secret, "\r\n")
+	} else {
+		return store.NewFileStore(opts.HistoryFile), nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read secret: %w", err)
+	}
+	return store.NewEncryptedFileStore(opts.HistoryFile, secret)
+}
+
+func compactHistory(ctx context.Context, logger *log.Logger, hist *history.History, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := hist.Compact(); err != nil {
+				logger.Printf("Failed to compact history: %s", err)
+			}
+		}
+	}
+}
+
+// expireClips periodically removes expired clips, and stops serving the selected one if it has expired.
+func expireClips(ctx context.Context, logger *log.Logger, hists *history.Histories, xconn *x.X, opts options) {
+	// check often enough that clips don't outlive their time by much
+	interval := time.Minute
+	for _, d := range []time.Duration{opts.MaxAge / 10, opts.SensitiveTTL / 10} {
+		if d > 0 && d < interval {
+			interval = d
+		}
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			selectedExpired, err := hists.Expire(now)
+			if err != nil {
+				logger.Printf("Failed to expire clips: %s", err)
+			}
+			if selectedExpired {
+				if err = xconn.DropSelectionOwner(); err != nil {
+					logger.Printf("Failed to drop selection after it expired: %s", err)
+				}
+			}
+		}
+	}
+}
+
+// reloadRules reloads the rules file whenever we receive SIGHUP.
+func reloadRules(ctx context.Context, logger *log.Logger, rs *rules.Set) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := rs.Reload(); err != nil {
+				logger.Printf("Failed to reload rules, keeping the old ones: %s", err)
+			} else {
+				logger.Print("Reloaded rules")
+			}
+		}
+	}
+}
+
+func defaultHistoryFile() string {
+	path, err := store.DefaultPath()
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+func defaultRulesFile() string {
+	path, err := rules.DefaultPath()
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+func defaultBlobDir() string {
+	path, err := store.DefaultBlobPath()
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+func processEvents(ctx context.Context, logger *log.Logger, hists *history.Histories, xconn *x.X, rs *rules.Set, opts options) {
 	go func() {
 		<-ctx.Done()
 		logger.Print("Shutting down")
@@ -128,20 +549,94 @@ func processEvents(ctx context.Context, logger *log.Logger, hist *history.Histor
 			logger.Println(xconn.DumpEvent(&ev))
 		}
 
-		handleEvent(ev, logger, hist, xconn, opts)
+		handleEvent(ev, logger, hists, xconn, rs, opts)
 	}
 }
 
-func handleEvent(ev xgb.Event, logger *log.Logger, hist *history.History, xconn *x.X, opts options) {
-	captureClip := func(data []byte, format history.ClipFormat) {
-		clip := history.Clip{Created: time.Now(), Value: data, Format: format, Source: "unknown"}
-		hist.Append(clip)
+func handleEvent(ev xgb.Event, logger *log.Logger, hists *history.Histories, xconn *x.X, rs *rules.Set, opts options) {
+	captureClip := func(sel *x.Selection) {
+		app := rs.App(sel.Owner.Class, sel.Owner.Title, sel.Name)
+		if app.Action == rules.Ignore {
+			logger.Printf("Not capturing clip from %s, matching app rule %s", sel.Owner.Class, app.Matched)
+			return
+		}
+		minSize := opts.MinClipSize
+		if app.MinSize >= 0 {
+			minSize = app.MinSize
+		}
+		if sel.Data == nil || len(sel.Data) < minSize {
+			// the owner couldn't give it to us, or it's too small to be worth keeping
+			return
+		}
+		if sel.Secret && opts.SecretMode == "skip" {
+			logger.Print("Not capturing clip marked as secret")
+			return
+		}
+		clip := history.Clip{
+			Created:   time.Now(),
+			Value:     sel.Data,
+			Format:    sel.Format,
+			Source:    sel.Owner.Class,
+			Title:     sel.Owner.Title,
+			PID:       sel.Owner.PID,
+			Selection: sel.Name,
+			Targets:   sel.Targets,
+			Sensitive: sel.Secret || app.Action == rules.CaptureSensitive,
+		}
+		if clip.Source == "" {
+			clip.Source = history.UnknownSource
+		}
+		// file lists are only paths, and masking them would break them
+		masked := false
+		if clip.Format.IsText() && clip.Format != history.FilesFormat {
+			r := rs.Apply(clip.Value)
+			if r.Drop {
+				logger.Printf("Not capturing clip matching rules %v", r.Matched)
+				return
+			}
+			masked = !bytes.Equal(r.Value, clip.Value)
+			clip.Value = r.Value
+			clip.Sensitive = clip.Sensitive || r.Sensitive
+
+			// the other targets are usually the same text marked up, so they need the same treatment
+			targets := make(map[string][]byte, len(clip.Targets))
+			for name, data := range clip.Targets {
+				r = rs.Apply(data)
+				if r.Drop {
+					logger.Printf("Not capturing clip with %s matching rules %v", name, r.Matched)
+					return
+				}
+				masked = masked || !bytes.Equal(r.Value, data)
+				targets[name] = r.Value
+				clip.Sensitive = clip.Sensitive || r.Sensitive
+			}
+			if clip.Targets != nil {
+				clip.Targets = targets
+			}
+		}
 
-		// Take the selection so that if someone pastes now, the data comes from us. This avoid the case of someone
-		// copying from vim, closing vim, then trying to paste it elsewhere.
-		err := xconn.BecomeSelectionOwner()
+		hist := hists.For(sel.Name)
+		clip, err := hist.Append(clip)
+		if err != nil {
+			logger.Printf("Failed to append clip: %s", err)
+		}
+
+		take := syncedSelections(opts.Sync, sel.Name)
+		if len(take) == 0 {
+			return
+		}
 
-		hist.SetSelected(&clip)
+		// Take the selection so that if someone pastes now, the data comes from us. This avoid the case of someone
+		// copying from vim, closing vim, then trying to paste it elsewhere. We are told when we take a selection, but
+		// ignore it, so syncing can't capture the clip again.
+		err = xconn.TakeSelections(take...)
+
+		if masked {
+			// only the history is masked: what was copied is what gets pasted, until something else is chosen
+			clip.Value, clip.Targets = sel.Data, sel.Targets
+			clip.Blob, clip.BlobSize = "", 0
+		}
+		hists.SetSelected(hist, &clip)
 		if err != nil {
 			logger.Printf("Failed to become selection owner after capturing clip: %s", err)
 		}
@@ -154,24 +649,29 @@ func handleEvent(ev xgb.Event, logger *log.Logger, hist *history.History, xconn
 			logger.Printf("Failed to convert selection: %s", err)
 		}
 
+	case xproto.ClientMessageEvent:
+		// PRIMARY may have settled
+		if err := xconn.ConvertSettled(ev); err != nil {
+			logger.Printf("Failed to convert selection: %s", err)
+		}
+
 	case xproto.SelectionNotifyEvent:
-		data, format, err := xconn.GetSelection(ev)
+		sel, err := xconn.GetSelection(ev)
 		if err != nil {
 			logger.Printf("Failed to get selection: %s", err)
 		}
-		if data != nil && len(data) >= opts.MinClipSize {
-			captureClip(data, format)
+		if sel != nil {
+			captureClip(sel)
 		}
 
 	case xproto.SelectionRequestEvent:
 		// Let the requestor know what target is available for the current clip
-		selectedClip := hist.GetSelected()
+		selectedClip := hists.GetSelected()
 
 		if selectedClip == nil {
 			logger.Print("Nothing in history to share")
 		} else {
-			err := xconn.SetSelection(ev, &selectedClip.Value, selectedClip.Format)
-			if err != nil {
+			if err := xconn.SetSelection(ev, selectedClip); err != nil {
 				logger.Printf("could not set selection for requestor: %s", err)
 			}
 		}
@@ -186,12 +686,13 @@ func handleEvent(ev xgb.Event, logger *log.Logger, hist *history.History, xconn
 				logger.Printf("error during INCR set selection: %s", err)
 			}
 		} else {
-			data, format, err := xconn.ContinueGetSelection(ev)
+			sel, err := xconn.ContinueGetSelection(ev)
 			if err != nil {
 				logger.Printf("error during INCR get selection: %s", err)
-			} else if data != nil {
+			}
+			if sel != nil {
 				// the INCR is complete
-				captureClip(data, format)
+				captureClip(sel)
 			}
 		}
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/maxjmax/clipclop/history"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+		err      bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"100B", 100, false},
+		{"64k", 64 << 10, false},
+		{"512KB", 512 << 10, false},
+		{" 1.5 MB ", 3 << 19, false},
+		{"2G", 2 << 30, false},
+		{"1gb", 1 << 30, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1MB", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.input)
+		if (err != nil) != tt.err || got != tt.expected {
+			t.Errorf("parseByteSize(%q): got %d, %v expected %d", tt.input, got, err, tt.expected)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		maxBytes    byteSize
+		formatBytes []string
+		expected    []history.FormatLimit
+		err         bool
+	}{
+		{0, nil, nil, false},
+		{1 << 20, []string{"files=1KB"}, []history.FormatLimit{{Formats: []history.ClipFormat{history.FilesFormat}, MaxBytes: 1 << 10}}, false},
+		{0, []string{"image=50MB", "text=10"}, []history.FormatLimit{
+			{Formats: history.ImageFormats, MaxBytes: 50 << 20},
+			{Formats: []history.ClipFormat{history.StringFormat, history.HtmlFormat}, MaxBytes: 10},
+		}, false},
+		{0, []string{"image"}, nil, true},
+		{0, []string{"video=1MB"}, nil, true},
+		{0, []string{"image=lots"}, nil, true},
+	}
+	for _, tt := range tests {
+		limits, err := parseLimits(options{MaxBytes: tt.maxBytes, MaxFormatBytes: tt.formatBytes})
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseLimits(%v): expected an error", tt.formatBytes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLimits(%v): unexpected error %s", tt.formatBytes, err)
+			continue
+		}
+		if limits.MaxBytes != int(tt.maxBytes) || !reflect.DeepEqual(limits.MaxFormatBytes, tt.expected) {
+			t.Errorf("parseLimits(%v): got %+v expected %v", tt.formatBytes, limits, tt.expected)
+		}
+	}
+}
+
+func TestSyncedSelections(t *testing.T) {
+	tests := []struct {
+		mode      string
+		selection string
+		expected  []string
+	}{
+		{"none", "CLIPBOARD", []string{"CLIPBOARD"}},
+		{"none", "PRIMARY", nil},
+		{"to-primary", "CLIPBOARD", []string{"CLIPBOARD", "PRIMARY"}},
+		{"to-primary", "PRIMARY", nil},
+		{"to-clipboard", "CLIPBOARD", []string{"CLIPBOARD"}},
+		{"to-clipboard", "PRIMARY", []string{"CLIPBOARD"}},
+		{"both", "CLIPBOARD", []string{"CLIPBOARD", "PRIMARY"}},
+		{"both", "PRIMARY", []string{"CLIPBOARD"}},
+		{"both", "SECONDARY", nil},
+	}
+	for _, tt := range tests {
+		if got := syncedSelections(tt.mode, tt.selection); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("syncedSelections(%q, %q): got %v expected %v", tt.mode, tt.selection, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// AppAction is what to do with clips copied from an application matching an AppRule.
+type AppAction int
+
+const (
+	// Capture clips as usual, optionally with a different minimum size.
+	Capture AppAction = iota
+	// Ignore clips, so that they are never captured.
+	Ignore
+	// CaptureSensitive keeps clips as sensitive clips, which expire after the sensitive TTL and are never written to
+	// disk.
+	CaptureSensitive
+)
+
+func (a AppAction) String() string {
+	switch a {
+	case Capture:
+		return "capture"
+	case Ignore:
+		return "ignore"
+	case CaptureSensitive:
+		return "sensitive"
+	}
+	return fmt.Sprintf("AppAction(%d)", int(a))
+}
+
+// AppRule applies an AppAction to clips copied from matching applications. Empty conditions match anything.
+type AppRule struct {
+	Name      string
+	Action    AppAction
+	Class     *regexp.Regexp // matched against the WM_CLASS of the application
+	Title     *regexp.Regexp // matched against the title of its window
+	Selection string         // e.g. clipboard or primary
+	MinSize   int            // -1 to use the usual minimum size
+}
+
+// AppResult is the outcome of applying the app rules to a clip.
+type AppResult struct {
+	Action  AppAction
+	MinSize int    // -1 to use the usual minimum size
+	Matched string // the name of the rule that matched, if any
+}
+
+func (r AppRule) matches(class, title, selection string) bool {
+	return (r.Class == nil || r.Class.MatchString(class)) &&
+		(r.Title == nil || r.Title.MatchString(title)) &&
+		(r.Selection == "" || strings.EqualFold(r.Selection, selection))
+}
+
+// App decides what to do with a clip copied from the application with the given WM_CLASS and window title, in the
+// given selection. The first matching rule is used, and clips from applications without one are captured as usual.
+func (s *Set) App(class, title, selection string) AppResult {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return applyApps(s.apps, class, title, selection)
+}
+
+func applyApps(apps []AppRule, class, title, selection string) AppResult {
+	for _, rule := range apps {
+		if rule.matches(class, title, selection) {
+			return AppResult{Action: rule.Action, MinSize: rule.MinSize, Matched: rule.Name}
+		}
+	}
+	return AppResult{Action: Capture, MinSize: -1}
+}
+
+// parseAppRule parses the part of an app line after "app": an action (capture, ignore or sensitive), a name, then
+// conditions and options separated by whitespace: class=pattern, title=pattern, selection=name and min-size=bytes.
+// Patterns can't contain spaces, so use \s to match them.
+func parseAppRule(line string) (AppRule, error) {
+	rule := AppRule{MinSize: -1}
+	action, rest := cutSpace(line)
+	name, rest := cutSpace(rest)
+	if name == "" {
+		return rule, errors.New("expected an action and a name after app")
+	}
+
+	switch action {
+	case "capture":
+		rule.Action = Capture
+	case "ignore":
+		rule.Action = Ignore
+	case "sensitive":
+		rule.Action = CaptureSensitive
+	default:
+		return rule, fmt.Errorf("unknown app action %q", action)
+	}
+	rule.Name = name
+
+	for _, field := range strings.Fields(rest) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return rule, fmt.Errorf("expected key=value for %s, got %q", name, field)
+		}
+
+		var err error
+		switch key {
+		case "class":
+			rule.Class, err = regexp.Compile(value)
+		case "title":
+			rule.Title, err = regexp.Compile(value)
+		case "selection":
+			rule.Selection = value
+		case "min-size":
+			rule.MinSize, err = strconv.Atoi(value)
+			if err == nil && rule.MinSize < 0 {
+				err = errors.New("must not be negative")
+			}
+		default:
+			return rule, fmt.Errorf("unknown condition %q for %s", key, name)
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid %s for %s: %w", key, name, err)
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,77 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAppRules(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"app ignore keepass class=(?i)^keepassxc$", ""},
+		{"app capture editor class=code min-size=20 selection=clipboard", ""},
+		{"app sensitive bank title=(?i)my\\sbank", ""},
+		{"app ignore", "line 1: expected an action and a name"},
+		{"app keep editor class=code", "line 1: unknown app action"},
+		{"app ignore editor class", "line 1: expected key=value"},
+		{"app ignore editor colour=red", "line 1: unknown condition"},
+		{"# ok\napp ignore editor class=(", "line 2: invalid class"},
+		{"app capture editor min-size=-1", "line 1: invalid min-size"},
+	}
+
+	for _, tc := range tests {
+		_, apps, err := Parse(strings.NewReader(tc.input))
+		if tc.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Errorf("Parse(%q): expected error %q, got %v", tc.input, tc.err, err)
+			}
+			continue
+		}
+		if err != nil || len(apps) != 1 {
+			t.Errorf("Parse(%q): got %v, %v", tc.input, apps, err)
+		}
+	}
+}
+
+func TestApplyAppRules(t *testing.T) {
+	input := `
+mask     card      \d{4}
+app ignore    keepass   class=(?i)^keepassxc$
+app ignore    private   title=(?i)private\sbrowsing
+app ignore    term      class=(?i)alacritty selection=primary
+app capture   term      class=(?i)alacritty min-size=1
+app sensitive bank      title=(?i)bank
+`
+	rules, apps, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Could not parse rules: %s", err)
+	}
+	if len(rules) != 1 || len(apps) != 5 {
+		t.Fatalf("Got %d rules and %d app rules", len(rules), len(apps))
+	}
+
+	tests := []struct {
+		class, title, selection string
+		action                  AppAction
+		minSize                 int
+		matched                 string
+	}{
+		{"KeePassXC", "Passwords.kdbx", "CLIPBOARD", Ignore, -1, "keepass"},
+		{"firefox", "Mozilla Firefox Private Browsing", "CLIPBOARD", Ignore, -1, "private"},
+		{"firefox", "Mozilla Firefox", "CLIPBOARD", Capture, -1, ""},
+		{"Alacritty", "vim", "PRIMARY", Ignore, -1, "term"},
+		{"Alacritty", "vim", "CLIPBOARD", Capture, 1, "term"},
+		{"firefox", "My Bank", "CLIPBOARD", CaptureSensitive, -1, "bank"},
+		{"", "", "CLIPBOARD", Capture, -1, ""},
+	}
+
+	for _, tc := range tests {
+		r := applyApps(apps, tc.class, tc.title, tc.selection)
+		if r.Action != tc.action || r.MinSize != tc.minSize || r.Matched != tc.matched {
+			t.Errorf("App(%q, %q, %q): got %v, expected %v %d %q",
+				tc.class, tc.title, tc.selection, r, tc.action, tc.minSize, tc.matched)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Package rules decides what happens to clips containing things that shouldn't be kept, such as keys and tokens, and
+// to clips copied from applications that shouldn't be captured from, such as password managers.
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Action is what to do with a clip matching a rule.
+type Action int
+
+const (
+	// Drop the clip, so that it is never captured.
+	Drop Action = iota
+	// Mask the matching text with asterisks, and keep the rest of the clip.
+	Mask
+	// Sensitive keeps the clip as it is, but it expires after the sensitive TTL and is never written to disk.
+	Sensitive
+)
+
+func (a Action) String() string {
+	switch a {
+	case Drop:
+		return "drop"
+	case Mask:
+		return "mask"
+	case Sensitive:
+		return "sensitive"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// Rule applies an Action to clips matching Pattern.
+type Rule struct {
+	Name    string
+	Action  Action
+	Pattern *regexp.Regexp
+	Check   func(match []byte) bool // if set, only matches it accepts count
+}
+
+// checks can follow the action in a rules file, e.g. mask:luhn, to weed out matches that aren't what we are after.
+var checks = map[string]func([]byte) bool{
+	"luhn": luhn,
+}
+
+// Default is used when there is no rules file. It is in the same format as a rules file.
+const Default = `# action     name         pattern
+drop         aws-key      \b(?:AKIA|ASIA)[0-9A-Z]{16}\b
+drop         private-key  -----BEGIN [A-Z ]*PRIVATE KEY-----
+sensitive    jwt          \beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+
+mask:luhn    card-number  \b(?:\d[ -]?){12,18}\d\b
+
+# app  action     name       conditions
+app    ignore     keepassxc  class=(?i)^keepassxc$
+`
+
+// Result is the outcome of applying the rules to a clip.
+type Result struct {
+	Value     []byte   // the clip, with any masked text replaced
+	Drop      bool     // the clip should not be captured
+	Sensitive bool     // the clip should be kept as a sensitive clip
+	Matched   []string // the names of the rules that matched
+}
+
+// Set is a list of rules loaded from a file, which can be reloaded while in use.
+type Set struct {
+	path  string
+	rules []Rule
+	apps  []AppRule
+	mu    sync.RWMutex
+}
+
+// NewSet loads rules from path. If path is empty or doesn't exist, the Default rules are used.
+func NewSet(path string) (*Set, error) {
+	s := Set{path: path}
+	return &s, s.Reload()
+}
+
+// DefaultPath returns the location of the rules file, following the XDG base directory spec.
+func DefaultPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("could not find config directory: %w", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "clipclop", "rules"), nil
+}
+
+// Reload reads the rules file again. If it can't be read or parsed, the existing rules are kept.
+func (s *Set) Reload() error {
+	rules, apps, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules, s.apps = rules, apps
+	return nil
+}
+
+func (s *Set) load() ([]Rule, []AppRule, error) {
+	if s.path == "" {
+		return Parse(strings.NewReader(Default))
+	}
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Parse(strings.NewReader(Default))
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("could not open rules file: %w", err)
+	}
+	defer f.Close()
+
+	rules, apps, err := Parse(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return rules, apps, nil
+}
+
+// Apply checks data against every rule. Dropping takes precedence over everything else, and masking is applied
+// before the sensitive rules are checked, so that they see what will be kept.
+func (s *Set) Apply(data []byte) Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return apply(s.rules, data)
+}
+
+func apply(rules []Rule, data []byte) Result {
+	r := Result{Value: data}
+	for _, action := range []Action{Drop, Mask, Sensitive} {
+		for _, rule := range rules {
+			if rule.Action != action || !rule.match(r.Value) {
+				continue
+			}
+			r.Matched = append(r.Matched, rule.Name)
+
+			switch action {
+			case Drop:
+				r.Drop = true
+			case Mask:
+				r.Value = rule.Pattern.ReplaceAllFunc(r.Value, func(m []byte) []byte {
+					if rule.Check != nil && !rule.Check(m) {
+						return m
+					}
+					return bytes.Repeat([]byte{'*'}, utf8.RuneCount(m))
+				})
+			case Sensitive:
+				r.Sensitive = true
+			}
+		}
+		if r.Drop {
+			return r
+		}
+	}
+	return r
+}
+
+// Parse reads rules, one per line, as an action (drop, mask or sensitive), a name and a regular expression, separated
+// by whitespace. Everything after the name is the expression. The action can be followed by a check that matches must
+// pass, as in mask:luhn. Lines starting with app are app rules, as described by parseAppRule. Blank lines and lines
+// starting with # are ignored.
+func Parse(r io.Reader) ([]Rule, []AppRule, error) {
+	var rules []Rule
+	var apps []AppRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if kind, rest := cutSpace(line); kind == "app" {
+			app, err := parseAppRule(rest)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			apps = append(apps, app)
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, apps, scanner.Err()
+}
+
+func parseRule(line string) (Rule, error) {
+	var rule Rule
+	action, rest := cutSpace(line)
+	name, pattern := cutSpace(rest)
+	if name == "" || pattern == "" {
+		return rule, errors.New("expected an action, a name and a pattern")
+	}
+
+	action, check, _ := strings.Cut(action, ":")
+	if check != "" {
+		if rule.Check = checks[check]; rule.Check == nil {
+			return rule, fmt.Errorf("unknown check %q", check)
+		}
+	}
+
+	switch action {
+	case "drop":
+		rule.Action = Drop
+	case "mask":
+		rule.Action = Mask
+	case "sensitive":
+		rule.Action = Sensitive
+	default:
+		return rule, fmt.Errorf("unknown action %q", action)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return rule, fmt.Errorf("invalid pattern for %s: %w", name, err)
+	}
+	rule.Name, rule.Pattern = name, re
+	return rule, nil
+}
+
+// match reports whether the rule matches anywhere in data.
+func (r Rule) match(data []byte) bool {
+	if r.Check == nil {
+		return r.Pattern.Match(data)
+	}
+	for _, m := range r.Pattern.FindAll(data, -1) {
+		if r.Check(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// luhn reports whether the digits in b, ignoring anything else, pass the Luhn checksum used by card numbers.
+func luhn(b []byte) bool {
+	sum, n := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < '0' || b[i] > '9' {
+			continue
+		}
+		d := int(b[i] - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n > 0 && sum%10 == 0
+}
+
+// cutSpace splits s around its first run of whitespace.
+func cutSpace(s string) (string, string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
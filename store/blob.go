@@ -0,0 +1,104 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/maxjmax/clipclop/history"
+)
+
+// BlobDir keeps the contents of large clips in a directory, one file per blob, named by the SHA-256 of its contents.
+type BlobDir struct {
+	dir string
+}
+
+func NewBlobDir(dir string) (*BlobDir, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("could not create blob directory: %w", err)
+	}
+	return &BlobDir{dir: dir}, nil
+}
+
+// DefaultBlobPath returns the location of the blob directory, alongside the history file.
+func DefaultBlobPath() (string, error) {
+	path, err := DefaultPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "blobs"), nil
+}
+
+func (b *BlobDir) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := b.path(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil // we already have it
+	}
+
+	tmp, err := os.CreateTemp(b.dir, hash+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
+
+func (b *BlobDir) Open(hash string) (history.ClipReader, error) {
+	if !isHash(hash) {
+		return nil, fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return os.Open(b.path(hash))
+}
+
+func (b *BlobDir) Remove(hash string) error {
+	if !isHash(hash) {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	err := os.Remove(b.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *BlobDir) List() ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() && isHash(e.Name()) {
+			hashes = append(hashes, e.Name())
+		}
+	}
+	return hashes, nil
+}
+
+func (b *BlobDir) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+// isHash checks that we have been given a hash, and not some other path.
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
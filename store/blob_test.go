@@ -0,0 +1,158 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxjmax/clipclop/history"
+)
+
+func TestBlobDir(t *testing.T) {
+	b, err := NewBlobDir(filepath.Join(t.TempDir(), "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := b.Put([]byte("some large clip"))
+	if err != nil {
+		t.Fatalf("Could not put blob: %s", err)
+	}
+	if again, _ := b.Put([]byte("some large clip")); again != hash {
+		t.Errorf("Same contents should give the same hash: %s != %s", again, hash)
+	}
+
+	r, err := b.Open(hash)
+	if err != nil {
+		t.Fatalf("Could not open blob: %s", err)
+	}
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, 1<<20))
+	r.Close()
+	if err != nil || string(data) != "some large clip" {
+		t.Errorf("Wrong contents: %q, %v", data, err)
+	}
+
+	if hashes, _ := b.List(); len(hashes) != 1 || hashes[0] != hash {
+		t.Errorf("Wrong blobs listed: %v", hashes)
+	}
+	if err = b.Remove(hash); err != nil {
+		t.Errorf("Could not remove blob: %s", err)
+	}
+	if hashes, _ := b.List(); len(hashes) != 0 {
+		t.Errorf("Blob was not removed: %v", hashes)
+	}
+
+	if _, err = b.Open("../../etc/passwd"); err == nil {
+		t.Error("Should not open paths outside of the blob directory")
+	}
+}
+
+func TestHistoryBlobs(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewBlobDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := history.NewHistory(2, nil)
+	h.SetBlobs(b, 100)
+	if err = h.Persist(NewFileStore(filepath.Join(dir, "history"))); err != nil {
+		t.Fatal(err)
+	}
+
+	large := "first line of a large clip\n" + strings.Repeat("0123456789\n", 20)
+	c, err := h.Append(newTestClip(large, time.Hour))
+	if err != nil {
+		t.Fatalf("Could not append: %s", err)
+	}
+	if c.Value != nil || c.Blob == "" || c.Size() != len(large) {
+		t.Fatalf("Large clip should have been moved to a blob: %+v", c)
+	}
+	if got := history.HistoryFormatter(c); !strings.Contains(got, "first line of a large clip") || !strings.HasSuffix(got, "[+21 lines]") {
+		t.Errorf("Wrong description of clip in blob: %q", got)
+	}
+	if data, err := c.Bytes(); err != nil || string(data) != large {
+		t.Errorf("Wrong contents read back: %v", err)
+	}
+
+	small, _ := h.Append(newTestClip("small", 30*time.Minute))
+	if small.Blob != "" {
+		t.Error("Small clip should be in memory")
+	}
+
+	// Blobs are restored along with the history
+	restored := history.NewHistory(2, nil)
+	restored.SetBlobs(b, 100)
+	if err = restored.Persist(NewFileStore(filepath.Join(dir, "history"))); err != nil {
+		t.Fatalf("Could not restore: %s", err)
+	}
+	if rc, err := restored.FindByID(c.ID); err != nil {
+		t.Errorf("Clip in blob was not restored: %s", err)
+	} else if data, err := rc.Bytes(); err != nil || string(data) != large {
+		t.Errorf("Wrong contents read back after restore: %v", err)
+	}
+
+	// Once evicted, the blob is removed
+	for i := 0; i < 2; i++ {
+		restored.Append(newTestClip(fmt.Sprint("newer ", i), time.Duration(10-i)*time.Minute))
+	}
+	if hashes, _ := b.List(); len(hashes) != 0 {
+		t.Errorf("Blob should have been removed with its clip: %v", hashes)
+	}
+
+	// A selected clip keeps its blob until something else is selected
+	sel, _ := restored.Append(newTestClip(large, 5*time.Minute))
+	restored.SetSelected(&sel)
+	for i := 0; i < 2; i++ {
+		restored.Append(newTestClip(fmt.Sprint("later ", i), time.Duration(4-i)*time.Minute))
+	}
+	if hashes, _ := b.List(); len(hashes) != 1 {
+		t.Errorf("Blob of selected clip should have been kept: %v", hashes)
+	}
+	restored.SetSelected(nil)
+	restored.Append(newTestClip("last", time.Minute))
+	if hashes, _ := b.List(); len(hashes) != 0 {
+		t.Errorf("Blob should have been removed once no longer selected: %v", hashes)
+	}
+
+	// And any strays are cleaned up
+	b.Put([]byte("stray"))
+	if err = restored.CollectBlobs(); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ := b.List(); len(hashes) != 0 {
+		t.Errorf("Stray blob should have been removed: %v", hashes)
+	}
+}
+
+func TestHistoryBlobsRestart(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewBlobDir(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := history.NewHistory(2, nil)
+	h.SetBlobs(b, 10)
+	if err = h.Persist(NewFileStore(filepath.Join(dir, "history"))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		h.Append(newTestClip(fmt.Sprint("a large enough clip ", i), time.Duration(3-i)*time.Minute))
+	}
+	if hashes, _ := b.List(); len(hashes) != 2 {
+		t.Errorf("Expected the evicted clip's blob to be removed: %v", hashes)
+	}
+
+	// the evicted clip mustn't be left in the file without its blob
+	restored := history.NewHistory(2, nil)
+	restored.SetBlobs(b, 10)
+	if err = restored.Persist(NewFileStore(filepath.Join(dir, "history"))); err != nil {
+		t.Errorf("Could not restore cleanly: %s", err)
+	}
+	if n := len(restored.Format(history.HistoryFormatter)); n != 2 {
+		t.Errorf("Expected 2 clips to be restored, got %d", n)
+	}
+}
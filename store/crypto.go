@@ -0,0 +1,159 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+)
+
+const (
+	encryptedMagic = "clipclop-aes-gcm-v1"
+	saltSize       = 16
+	keyIterations  = 200000
+)
+
+// aeadCodec encrypts each record with AES-256-GCM. The key is derived from a secret and a per-file salt, which is
+// kept in the header. The header and the record's sequence number are used as additional data, so records can't be
+// moved between files, or deleted, reordered or repeated within one without the records after them failing. Records
+// cut from the end of the file can't be spotted, but are no different from clips which were never persisted.
+type aeadCodec struct {
+	salt []byte
+	aead cipher.AEAD
+}
+
+// NewEncryptedFileStore returns a FileStore that encrypts every record with a key derived from secret, which may be
+// the contents of a keyfile or a passphrase.
+func NewEncryptedFileStore(path string, secret []byte) (*FileStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+
+	salt, err := readSalt(path)
+	if err != nil {
+		return nil, err
+	}
+	if salt == nil {
+		salt = make([]byte, saltSize)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("could not generate salt: %w", err)
+		}
+	}
+
+	block, err := aes.NewCipher(pbkdf2(secret, salt, keyIterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{path: path, codec: &aeadCodec{salt: salt, aead: aead}}, nil
+}
+
+func (c *aeadCodec) header() []byte {
+	return []byte(encryptedMagic + " " + base64.StdEncoding.EncodeToString(c.salt))
+}
+
+// additionalData binds a record to its place in this file.
+func (c *aeadCodec) additionalData(seq uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return append(c.header(), buf[:]...)
+}
+
+func (c *aeadCodec) seal(record []byte, seq uint64) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(record)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, record, c.additionalData(seq))
+
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(line, sealed)
+	return line, nil
+}
+
+func (c *aeadCodec) open(line []byte, seq uint64) ([]byte, error) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errMalformed, err)
+	}
+	sealed = sealed[:n]
+
+	if len(sealed) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, fmt.Errorf("%w: record too short", errMalformed)
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, ciphertext, c.additionalData(seq))
+}
+
+// readSalt returns the salt from the header of an existing encrypted file, or nil if there is no file yet.
+func readSalt(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if len(line) == 0 && err != nil {
+		return nil, nil // empty file, treat as new
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) != 2 || string(fields[0]) != encryptedMagic {
+		return nil, fmt.Errorf("%s is not an encrypted history file", path)
+	}
+	salt, err := base64.StdEncoding.DecodeString(string(fields[1]))
+	if err != nil || len(salt) != saltSize {
+		return nil, fmt.Errorf("%s has an invalid header", path)
+	}
+	return salt, nil
+}
+
+// pbkdf2 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+func pbkdf2(secret, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, secret)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	key := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		u = mac(prf, u[:0], salt, buf[:])
+		t := append([]byte{}, u...)
+		for n := 2; n <= iter; n++ {
+			u = mac(prf, u[:0], u)
+			for i := range t {
+				t[i] ^= u[i]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func mac(prf hash.Hash, out []byte, parts ...[]byte) []byte {
+	prf.Reset()
+	for _, p := range parts {
+		prf.Write(p)
+	}
+	return prf.Sum(out)
+}
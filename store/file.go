@@ -0,0 +1,295 @@
+// Package store persists clipboard history to disk.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/maxjmax/clipclop/history"
+)
+
+// ErrTampered is wrapped by errors from Load when records fail authentication, either because they have been
+// modified or because the key is wrong. Unlike plain corruption this is not recoverable, as compacting would throw
+// the whole history away.
+var ErrTampered = errors.New("history records failed authentication")
+
+// FileStore keeps clips in an append-only file, one JSON record per line. Appending is cheap, and the file is
+// periodically rewritten to drop clips that have fallen out of the history.
+type FileStore struct {
+	path  string
+	codec codec
+	mu    sync.Mutex
+
+	// where the next record goes, once we have read the file
+	counted bool
+	records uint64 // lines after the header, which is the sequence number of the next record
+	end     int64  // offset after the last complete line
+}
+
+// codec transforms each encoded record before it is written to a line of the file. Each record is given its sequence
+// number in the file, so that codecs can tell if records have been moved.
+type codec interface {
+	// header is written as the first line of the file, or nil if there isn't one.
+	header() []byte
+	seal(record []byte, seq uint64) ([]byte, error)
+	// open returns an error wrapping errMalformed if the line couldn't have been written by seal, as when a write is
+	// cut short, rather than having been tampered with.
+	open(line []byte, seq uint64) ([]byte, error)
+}
+
+// errMalformed is returned by codecs for lines which are corrupt rather than tampered with.
+var errMalformed = errors.New("malformed record")
+
+type plainCodec struct{}
+
+func (plainCodec) header() []byte                                 { return nil }
+func (plainCodec) seal(record []byte, seq uint64) ([]byte, error) { return record, nil }
+func (plainCodec) open(line []byte, seq uint64) ([]byte, error)   { return line, nil }
+
+// LoadError is returned by Load when some records could not be recovered.
+type LoadError struct {
+	Skipped  int
+	Tampered int
+}
+
+func (e *LoadError) Error() string {
+	if e.Tampered > 0 {
+		return fmt.Sprintf("%d records failed authentication (tampered, or wrong key), %d corrupt", e.Tampered, e.Skipped)
+	}
+	return fmt.Sprintf("skipped %d corrupt records", e.Skipped)
+}
+
+func (e *LoadError) Is(target error) bool {
+	if e.Tampered > 0 {
+		return target == ErrTampered
+	}
+	return target == history.ErrCorrupt
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path, codec: plainCodec{}}
+}
+
+// DefaultPath returns the location of the history file under $XDG_DATA_HOME, falling back to ~/.local/share.
+func DefaultPath() (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "clipclop", "history"), nil
+}
+
+func (s *FileStore) Load() ([]history.Clip, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var clips []history.Clip
+	var loadErr LoadError
+	partial, err := s.scan(f, func(line []byte, seq uint64) error {
+		if seq == 0 && bytes.HasPrefix(line, []byte(encryptedMagic)) {
+			// Don't treat it as corrupt, or we will compact it away
+			return fmt.Errorf("%s is encrypted, but no key was given", s.path)
+		}
+
+		record, err := s.codec.open(line, seq)
+		if errors.Is(err, errMalformed) {
+			loadErr.Skipped++
+			return nil
+		} else if err != nil {
+			loadErr.Tampered++
+			return nil
+		}
+		var c history.Clip
+		if err := json.Unmarshal(record, &c); err != nil {
+			loadErr.Skipped++
+			return nil
+		}
+		clips = append(clips, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if partial {
+		// the last write was cut short, and will be cut off by the next append
+		loadErr.Skipped++
+	}
+
+	if loadErr.Skipped > 0 || loadErr.Tampered > 0 {
+		return clips, &loadErr
+	}
+	return clips, nil
+}
+
+// scan calls each for every record in the file, with its sequence number, and notes where the next one goes. It
+// reports whether the file ends with part of a line.
+func (s *FileStore) scan(r io.Reader, each func(line []byte, seq uint64) error) (bool, error) {
+	s.counted = false
+	var records uint64
+	var end int64
+	header := s.codec.header()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			s.counted, s.records, s.end = true, records, end
+			return len(line) > 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		end += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if header != nil {
+			if !bytes.Equal(line, header) {
+				return false, fmt.Errorf("%s does not start with the expected header", s.path)
+			}
+			header = nil
+			continue
+		}
+		if err = each(line, records); err != nil {
+			return false, err
+		}
+		records++
+	}
+}
+
+func (s *FileStore) Append(c history.Clip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	if err = s.seekEnd(f); err == nil {
+		err = s.write(f, c)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// seekEnd moves to where the next record goes in f, cutting off any partial line left by a write that was cut short
+// so that the record doesn't end up on the same line.
+func (s *FileStore) seekEnd(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !s.counted || info.Size() < s.end {
+		if _, err = s.scan(f, func([]byte, uint64) error { return nil }); err != nil {
+			return err
+		}
+	}
+	if info.Size() > s.end {
+		if err = f.Truncate(s.end); err != nil {
+			return err
+		}
+	}
+	_, err = f.Seek(s.end, io.SeekStart)
+	return err
+}
+
+// write writes c as the next record, after the header if the file is empty.
+func (s *FileStore) write(w io.Writer, c history.Clip) error {
+	line, err := s.encode(c, s.records)
+	if err != nil {
+		return err
+	}
+	if header := s.codec.header(); header != nil && s.end == 0 {
+		line = append(append(header, '\n'), line...)
+	}
+	if _, err = w.Write(line); err != nil {
+		s.counted = false // we don't know how much made it
+		return err
+	}
+	s.records++
+	s.end += int64(len(line))
+	return nil
+}
+
+func (s *FileStore) Rewrite(clips []history.Clip) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	// Write everything to a temporary file and swap it in, so a crash part way through leaves the old file intact.
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	w := bufio.NewWriter(tmp)
+	s.records, s.end = 0, 0
+	for _, c := range clips {
+		if err = s.write(w, c); err != nil {
+			tmp.Close()
+			s.counted = false
+			return err
+		}
+	}
+	if len(clips) == 0 && s.codec.header() != nil {
+		w.Write(append(s.codec.header(), '\n')) // any error is returned by Flush
+		s.end = int64(len(s.codec.header()) + 1)
+	}
+	if err = w.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	// if it went wrong, the old file is still there, so read it again before appending
+	s.counted = err == nil
+	return err
+}
+
+func (s *FileStore) encode(c history.Clip, seq uint64) ([]byte, error) {
+	b, err := json.Marshal(c)
+	if err == nil {
+		b, err = s.codec.seal(b, seq)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode clip: %w", err)
+	}
+	return append(b, '\n'), nil
+}
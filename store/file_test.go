@@ -0,0 +1,316 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxjmax/clipclop/history"
+)
+
+func newTestClip(s string, age time.Duration) history.Clip {
+	return history.Clip{Created: time.Now().Add(-age).Round(0), Value: []uint8(s), Format: history.StringFormat, Source: "test"}
+}
+
+func getValues(clips []history.Clip) string {
+	r := make([]string, 0, len(clips))
+	for _, c := range clips {
+		r = append(r, string(c.Value))
+	}
+	return strings.Join(r, "|")
+}
+
+var stores = []struct {
+	name string
+	new  func(t *testing.T, path string) *FileStore
+}{
+	{"plain", func(t *testing.T, path string) *FileStore { return NewFileStore(path) }},
+	{"encrypted", func(t *testing.T, path string) *FileStore {
+		s, err := NewEncryptedFileStore(path, []byte("correct horse battery staple"))
+		if err != nil {
+			t.Fatalf("Could not create encrypted store: %s", err)
+		}
+		return s
+	}},
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clipclop", "history")
+			s := tt.new(t, path)
+
+			clips := []history.Clip{
+				newTestClip("hello", time.Hour),
+				newTestClip("multiple\nlines\n", time.Minute),
+				{Created: time.Now().Round(0), Value: []uint8{0x89, 'P', 'N', 'G', 0, 0xff}, Format: history.PngFormat, Source: "test"},
+				{
+					Created: time.Now().Round(0), Value: []uint8("rich"), Format: history.StringFormat, Source: "test",
+					Targets: map[string][]byte{"text/html": []byte("<b>rich</b>")},
+				},
+			}
+			for _, c := range clips {
+				if err := s.Append(c); err != nil {
+					t.Fatalf("Could not append: %s", err)
+				}
+			}
+
+			// Reopen the store, as we would on a restart
+			loaded, err := tt.new(t, path).Load()
+			if err != nil {
+				t.Fatalf("Could not load: %s", err)
+			}
+			if len(loaded) != len(clips) {
+				t.Fatalf("Wrong number of clips loaded: got %d expected %d", len(loaded), len(clips))
+			}
+			for i, c := range loaded {
+				if string(c.Value) != string(clips[i].Value) || c.Format != clips[i].Format ||
+					c.Source != clips[i].Source || !c.Created.Equal(clips[i].Created) ||
+					string(c.Targets["text/html"]) != string(clips[i].Targets["text/html"]) {
+					t.Errorf("Clip did not survive the round trip: got %v expected %v", c, clips[i])
+				}
+			}
+
+			if err = s.Rewrite(loaded[1:2]); err != nil {
+				t.Fatalf("Could not rewrite: %s", err)
+			}
+			if err = s.Append(newTestClip("after rewrite", 0)); err != nil {
+				t.Fatalf("Could not append: %s", err)
+			}
+			loaded, err = tt.new(t, path).Load()
+			if got := getValues(loaded); err != nil || got != "multiple\nlines\n|after rewrite" {
+				t.Errorf("Rewrite was wrong, got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	s := stores[1].new(t, path)
+	for _, v := range []string{"hunter2", "s3cret", "password123"} {
+		if err := s.Append(newTestClip(v, time.Minute)); err != nil {
+			t.Fatalf("Could not append: %s", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Fatal("History file contains plaintext")
+	}
+
+	if _, err = NewFileStore(path).Load(); err == nil || errors.Is(err, history.ErrCorrupt) {
+		t.Errorf("Loading an encrypted file without a key should fail, got %v", err)
+	}
+
+	wrongKey, err := NewEncryptedFileStore(path, []byte("wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wrongKey.Load(); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected the wrong key to be detected, got %v", err)
+	}
+
+	// flip a bit in the middle of the second record, keeping it valid base64
+	lines := strings.SplitAfter(string(data), "\n")
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 1
+	lines[2] = base64.StdEncoding.EncodeToString(b) + "\n"
+	if err = os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clips, err := s.Load()
+	if !errors.Is(err, ErrTampered) || errors.Is(err, history.ErrCorrupt) {
+		t.Errorf("Expected tampering to be detected, got %v", err)
+	}
+	if got := getValues(clips); got != "hunter2|password123" {
+		t.Errorf("Wrong clips loaded: %q", got)
+	}
+	if err = history.NewHistory(5, nil).Persist(s); !errors.Is(err, ErrTampered) {
+		t.Errorf("Expected Persist to refuse a tampered store, got %v", err)
+	}
+}
+
+func TestEncryptedFileStoreOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	s := stores[1].new(t, path)
+	for _, v := range []string{"one", "two", "three"} {
+		if err := s.Append(newTestClip(v, time.Minute)); err != nil {
+			t.Fatalf("Could not append: %s", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n") // the header, three records and an empty string
+
+	tests := []struct {
+		name     string
+		lines    []string
+		expected string
+	}{
+		{"deleted", []string{lines[0], lines[1], lines[3]}, "one"},
+		{"reordered", []string{lines[0], lines[2], lines[1], lines[3]}, "three"},
+		{"replayed", []string{lines[0], lines[1], lines[2], lines[3], lines[1]}, "one|two|three"},
+	}
+	for _, tt := range tests {
+		if err = os.WriteFile(path, []byte(strings.Join(tt.lines, "")), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		clips, err := stores[1].new(t, path).Load()
+		if !errors.Is(err, ErrTampered) {
+			t.Errorf("Expected records to be %s to be detected, got %v", tt.name, err)
+		}
+		if got := getValues(clips); got != tt.expected {
+			t.Errorf("Wrong clips loaded when %s: %q", tt.name, got)
+		}
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector from RFC 7914 section 11
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64))
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != expected {
+		t.Errorf("Wrong key derived: got %s", got)
+	}
+}
+
+func TestFileStoreMissingFile(t *testing.T) {
+	s := NewFileStore(filepath.Join(t.TempDir(), "nothing-here"))
+	clips, err := s.Load()
+	if err != nil || len(clips) != 0 {
+		t.Fatalf("Expected an empty history, got %v, %s", clips, err)
+	}
+}
+
+func TestFileStoreCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	s := NewFileStore(path)
+	for i := 0; i < 4; i++ {
+		if err := s.Append(newTestClip(fmt.Sprint("clip ", i), time.Hour)); err != nil {
+			t.Fatalf("Could not append: %s", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	// mangle the second record, and cut the last one short
+	lines[1] = "{not json\n"
+	lines[3] = lines[3][:len(lines[3])/2]
+	if err = os.WriteFile(path, []byte(strings.Join(lines, "")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	clips, err := s.Load()
+	if !errors.Is(err, history.ErrCorrupt) {
+		t.Errorf("Expected a corrupt error, got %v", err)
+	}
+	if got := getValues(clips); got != "clip 0|clip 2" {
+		t.Errorf("Recovered the wrong clips: got %q", got)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history")
+			s := tt.new(t, path)
+			for i := 0; i < 2; i++ {
+				if err := s.Append(newTestClip(fmt.Sprint("clip ", i), time.Hour)); err != nil {
+					t.Fatalf("Could not append: %s", err)
+				}
+			}
+
+			// the next write is cut short, and we restart
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.SplitAfter(string(data), "\n")
+			partial := lines[len(lines)-2][:9]
+			if err = os.WriteFile(path, append(data, partial...), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			clips, err := tt.new(t, path).Load()
+			if !errors.Is(err, history.ErrCorrupt) || errors.Is(err, ErrTampered) {
+				t.Errorf("Expected a cut short record to be corrupt, got %v", err)
+			}
+			if got := getValues(clips); got != "clip 0|clip 1" {
+				t.Errorf("Recovered the wrong clips: got %q", got)
+			}
+
+			// appending cuts it off, rather than running on from it
+			if err = tt.new(t, path).Append(newTestClip("clip 2", 0)); err != nil {
+				t.Fatalf("Could not append: %s", err)
+			}
+			clips, err = tt.new(t, path).Load()
+			if got := getValues(clips); err != nil || got != "clip 0|clip 1|clip 2" {
+				t.Errorf("Appending after a torn write was wrong: got %q, %v", got, err)
+			}
+
+			// an encrypted line which can't be decoded is corrupt too
+			if err = os.WriteFile(path, append(data, "not base64!\n"...), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tt.new(t, path).Load(); tt.name == "encrypted" && (!errors.Is(err, history.ErrCorrupt) || errors.Is(err, ErrTampered)) {
+				t.Errorf("Expected an undecodable record to be corrupt, got %v", err)
+			}
+		})
+	}
+}
+
+func TestHistoryPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h := history.NewHistory(3, []string{"preset"})
+	if err := h.Persist(NewFileStore(path)); err != nil {
+		t.Fatalf("Could not persist: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := h.Append(newTestClip(fmt.Sprint("clip ", i), time.Duration(5-i)*time.Hour)); err != nil {
+			t.Fatalf("Could not append: %s", err)
+		}
+	}
+	if err := h.Pin(h.Top().ID); err != nil {
+		t.Fatalf("Could not pin: %s", err)
+	}
+	h.Append(newTestClip("after pinning", 0))
+	format := func(c history.Clip) string { return string(c.Value) }
+	expected := strings.Join(h.Format(format), "|")
+
+	// A new history backed by the same file should pick up where we left off, before and after compaction
+	for i := 0; i < 2; i++ {
+		restored := history.NewHistory(3, []string{"preset"})
+		if err := restored.Persist(NewFileStore(path)); err != nil {
+			t.Fatalf("Could not restore: %s", err)
+		}
+		if got := strings.Join(restored.Format(format), "|"); got != expected {
+			t.Errorf("Restored history was wrong: got %s expected %s", got, expected)
+		}
+		if c, _ := restored.FindByID(h.Top().ID); c == nil || string(c.Value) != "after pinning" {
+			t.Errorf("IDs were not restored, got %v", c)
+		}
+	}
+
+	clips, _ := NewFileStore(path).Load()
+	if len(clips) != 4 {
+		t.Errorf("Expected the store to be compacted to 3 clips and a pin, got %d", len(clips))
+	}
+}
@@ -0,0 +1,82 @@
+package x
+
+import (
+	"bytes"
+
+	"github.com/BurntSushi/xgb/xproto"
+)
+
+// maxTreeDepth stops us walking up a broken window tree forever.
+const maxTreeDepth = 32
+
+// Owner is the application which owned a selection, as far as we can tell from its windows. Everything is empty if
+// it couldn't be found (e.g. xclip, which doesn't name its window).
+type Owner struct {
+	Class string // the class from WM_CLASS, e.g. firefox
+	Title string // _NET_WM_NAME, or WM_NAME
+	PID   int    // _NET_WM_PID, or zero
+}
+
+// owner finds the application owning window. Selections are often owned by a hidden or child window, so we walk up
+// the tree until we reach a window with a WM_CLASS, which is the top-level client, or the root.
+func (x *X) owner(window xproto.Window) Owner {
+	for i := 0; i < maxTreeDepth && window != xproto.WindowNone && window != x.screen.Root; i++ {
+		if class, ok := x.textProperty(window, xproto.AtomWmClass); ok {
+			return Owner{
+				Class: wmClass(class),
+				Title: x.windowTitle(window),
+				PID:   x.windowPID(window),
+			}
+		}
+
+		tree, err := xproto.QueryTree(x.conn, window).Reply()
+		if err != nil {
+			break
+		}
+		window = tree.Parent
+	}
+	return Owner{}
+}
+
+func (x *X) windowTitle(window xproto.Window) string {
+	if name, err := x.atom("_NET_WM_NAME"); err == nil {
+		if title, ok := x.textProperty(window, name); ok && len(title) > 0 {
+			return string(title)
+		}
+	}
+	title, _ := x.textProperty(window, xproto.AtomWmName)
+	return string(title)
+}
+
+func (x *X) windowPID(window xproto.Window) int {
+	name, err := x.atom("_NET_WM_PID")
+	if err != nil {
+		return 0
+	}
+	reply, err := xproto.GetProperty(x.conn, false, window, name, xproto.AtomCardinal, 0, 1).Reply()
+	if err != nil || reply.Format != 32 {
+		return 0
+	}
+	return int(unpackInt(reply.Value))
+}
+
+// textProperty reads a property of window of any type, reporting whether it was set.
+func (x *X) textProperty(window xproto.Window, property xproto.Atom) ([]byte, bool) {
+	reply, err := xproto.GetProperty(x.conn, false, window, property, AnyProperyType, 0, 1024).Reply()
+	if err != nil || reply.Type == xproto.AtomNone {
+		return nil, false
+	}
+	return reply.Value, true
+}
+
+// wmClass returns the class from a WM_CLASS property, which is the instance and class names, each followed by a NUL.
+// The instance name is used if there is no class.
+func wmClass(prop []byte) string {
+	parts := bytes.Split(bytes.TrimRight(prop, "\x00"), []byte{0})
+	for i := len(parts) - 1; i >= 0; i-- {
+		if len(parts[i]) > 0 {
+			return string(parts[i])
+		}
+	}
+	return ""
+}
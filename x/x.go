@@ -5,7 +5,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"reflect"
+	"sync"
+	"time"
+	"unicode/utf16"
 
 	"github.com/BurntSushi/xgb"
 	"github.com/BurntSushi/xgb/xfixes"
@@ -17,10 +21,42 @@ import (
 
 const AnyProperyType xproto.Atom = 0
 
+// DefaultSecretTargets are the targets offered by password managers (KeePassXC, Bitwarden...) to mark a selection as
+// secret.
+var DefaultSecretTargets = []string{"x-kde-passwordManagerHint"}
+
+// DefaultTargets are the targets we keep alongside the main one when they are offered, so that formatting survives a
+// paste (e.g. rich text from a browser into LibreOffice, or vim's block selections).
+var DefaultTargets = []string{
+	"text/rtf", "text/richtext", "_VIMENC_TEXT", "_VIM_TEXT",
+	"x-special/gnome-copied-files", "application/x-kde-cutselection",
+}
+
+// Selection is the contents of a selection, as read from its owner.
+type Selection struct {
+	Data    []byte
+	Format  history.ClipFormat
+	Targets map[string][]byte // the other targets we kept, by name
+	Secret  bool              // the owner offered one of the secret targets, so it is probably a password
+	Owner   Owner             // the application it was copied from
+	Name    string            // of the selection it was read from, e.g. CLIPBOARD
+}
+
+// fetch is a selection we are reading, one target at a time.
+type fetch struct {
+	sel     *Selection
+	targets []xproto.Atom // still to read, starting with the one we have requested
+	primary bool          // we have read the main target
+	time    xproto.Timestamp
+}
+
 type incr struct {
-	data      []byte // data we are sending
-	i         int    // index to write next
+	data      []byte             // data we are receiving
+	src       history.ClipReader // data we are sending
+	size      int                // length of src
+	i         int                // index to write next
 	seq       uint16
+	fetch     *fetch // what we are receiving is part of
 	selection xproto.Atom
 	target    xproto.Atom
 	property  xproto.Atom
@@ -34,6 +70,17 @@ type X struct {
 	wincrs      map[xproto.Window]*incr
 	rincrs      map[xproto.Window]*incr
 	maxPropSize int // maximum number of bytes for a property
+
+	secretTargets []xproto.Atom
+	keepTargets   []xproto.Atom
+	fetches       map[xproto.Atom]*fetch // by selection
+	owners        map[xproto.Atom]Owner  // by selection, until we have its targets
+	named         map[string]xproto.Atom
+	namedMu       sync.Mutex // atoms are looked up from the IPC server as well as the event loop
+
+	primaryDelay time.Duration
+	primary      *xfixes.SelectionNotifyEvent // the latest change to PRIMARY, waiting for it to settle
+	settle       *time.Timer                  // wakes us up once PRIMARY may have settled
 }
 
 type atoms struct {
@@ -43,6 +90,12 @@ type atoms struct {
 	incr              xproto.Atom
 	png               xproto.Atom
 	utf8              xproto.Atom
+	html              xproto.Atom
+	uriList           xproto.Atom
+	jpeg              xproto.Atom
+	gif               xproto.Atom
+	bmp               xproto.Atom
+	wake              xproto.Atom
 }
 
 func StartX() (*X, error) {
@@ -72,13 +125,25 @@ func StartX() (*X, error) {
 		incr:              createAtom(conn, "INCR"),
 		png:               createAtom(conn, "image/png"),
 		utf8:              createAtom(conn, "UTF8_STRING"),
+		html:              createAtom(conn, "text/html"),
+		uriList:           createAtom(conn, "text/uri-list"),
+		jpeg:              createAtom(conn, "image/jpeg"),
+		gif:               createAtom(conn, "image/gif"),
+		bmp:               createAtom(conn, "image/bmp"),
+		wake:              createAtom(conn, "CLIPCLOP_WAKE"),
 	}
 	if atoms.selectionProperty == xproto.AtomNone ||
 		atoms.clipboard == xproto.AtomNone ||
 		atoms.targets == xproto.AtomNone ||
 		atoms.incr == xproto.AtomNone ||
 		atoms.png == xproto.AtomNone ||
-		atoms.utf8 == xproto.AtomNone {
+		atoms.utf8 == xproto.AtomNone ||
+		atoms.html == xproto.AtomNone ||
+		atoms.uriList == xproto.AtomNone ||
+		atoms.jpeg == xproto.AtomNone ||
+		atoms.gif == xproto.AtomNone ||
+		atoms.bmp == xproto.AtomNone ||
+		atoms.wake == xproto.AtomNone {
 		return nil, fmt.Errorf("could not create atom: %v", atoms)
 	}
 
@@ -89,10 +154,47 @@ func StartX() (*X, error) {
 		maxPropSize: int(setup.MaximumRequestLength), // quarter of the max size in bytes
 		wincrs:      make(map[xproto.Window]*incr),
 		rincrs:      make(map[xproto.Window]*incr),
+		fetches:     make(map[xproto.Atom]*fetch),
+		owners:      make(map[xproto.Atom]Owner),
+		named:       make(map[string]xproto.Atom),
 	}, nil
 }
 
-func (x *X) CreateEventWindow() error {
+// SetTargets sets the targets to keep alongside the main one, replacing DefaultTargets.
+func (x *X) SetTargets(names []string) error {
+	x.keepTargets = x.keepTargets[:0]
+	for _, n := range names {
+		a, err := x.atom(n)
+		if err != nil {
+			return err
+		}
+		x.keepTargets = append(x.keepTargets, a)
+	}
+	return nil
+}
+
+// SetSecretTargets sets the targets which mark a selection as secret when offered, replacing DefaultSecretTargets.
+func (x *X) SetSecretTargets(names []string) error {
+	x.secretTargets = x.secretTargets[:0]
+	for _, n := range names {
+		a, err := x.atom(n)
+		if err != nil {
+			return err
+		}
+		x.secretTargets = append(x.secretTargets, a)
+	}
+	return nil
+}
+
+// SetPrimaryDelay sets how long PRIMARY must be left alone before we read it, so that we only capture the final
+// selection once a mouse selection has finished being dragged out. 0 reads it straight away.
+func (x *X) SetPrimaryDelay(d time.Duration) {
+	x.primaryDelay = d
+}
+
+// CreateEventWindow creates the window we own selections with, and asks for events when the named selections (e.g.
+// CLIPBOARD, PRIMARY or SECONDARY) change owner.
+func (x *X) CreateEventWindow(selections []string) error {
 	wid, err := xproto.NewWindowId(x.conn)
 	if err != nil {
 		return fmt.Errorf("could not get window ID: %w", err)
@@ -109,15 +211,14 @@ func (x *X) CreateEventWindow() error {
 
 	// Request events to it when the selection changes
 	var mask uint32 = xfixes.SelectionEventMaskSetSelectionOwner
-	// TODO: TESTING: ignore primary
-	/*
-		if err = xfixes.SelectSelectionInputChecked(x.conn, wid, xproto.AtomPrimary, mask).Check(); err != nil {
-			return fmt.Errorf("could not select primary selection events: %w", err)
+	for _, name := range selections {
+		sel, err := x.atom(name)
+		if err != nil {
+			return err
+		}
+		if err = xfixes.SelectSelectionInputChecked(x.conn, wid, sel, mask).Check(); err != nil {
+			return fmt.Errorf("could not select %s selection events: %w", name, err)
 		}
-	*/
-
-	if err = xfixes.SelectSelectionInputChecked(x.conn, wid, x.atoms.clipboard, mask).Check(); err != nil {
-		return fmt.Errorf("could not select clipboard selection events: %w", err)
 	}
 
 	x.window = wid
@@ -138,57 +239,174 @@ func (x *X) Close() {
 
 func (x *X) ConvertSelection(ev xfixes.SelectionNotifyEvent) error {
 	if x.isEventWindow(ev.Owner) {
+		if ev.Selection == xproto.AtomPrimary {
+			x.primary = nil // we have taken it since, so whatever we were waiting for has gone
+		}
 		return nil
 	}
 
+	if ev.Selection == xproto.AtomPrimary && x.primaryDelay > 0 {
+		// Wait for the selection to settle, as some applications take PRIMARY again each time a mouse selection
+		// grows, and we would capture every part of it.
+		x.primary = &ev
+		if x.settle == nil {
+			x.settle = time.AfterFunc(x.primaryDelay, x.wake)
+		} else {
+			x.settle.Reset(x.primaryDelay)
+		}
+		return nil
+	}
+	return x.convert(ev)
+}
+
+// ConvertSettled handles the ClientMessageEvent we send ourselves once PRIMARY may have settled, and requests it if
+// the mouse has been let go. Otherwise we wait a little longer.
+func (x *X) ConvertSettled(ev xproto.ClientMessageEvent) error {
+	if ev.Type != x.atoms.wake || x.primary == nil {
+		return nil
+	}
+
+	pointer, err := xproto.QueryPointer(x.conn, x.screen.Root).Reply()
+	if err == nil && pointer.Mask&(xproto.KeyButMaskButton1|xproto.KeyButMaskButton3) != 0 {
+		// still dragging
+		x.settle.Reset(x.primaryDelay)
+		return nil
+	}
+
+	pending := *x.primary
+	x.primary = nil
+	return x.convert(pending)
+}
+
+// wake sends an event to our own window, so that the event loop can handle PRIMARY settling in between the other
+// events. It is called from the settle timer's goroutine.
+func (x *X) wake() {
+	ev := xproto.ClientMessageEvent{
+		Format: 32,
+		Window: x.window,
+		Type:   x.atoms.wake,
+		Data:   xproto.ClientMessageDataUnionData32New(make([]uint32, 5)),
+	}
+	xproto.SendEvent(x.conn, false, x.window, xproto.EventMaskNoEvent, string(ev.Bytes()))
+}
+
+// convert asks the owner of a selection for its targets, so that we can choose one to read it in.
+func (x *X) convert(ev xfixes.SelectionNotifyEvent) error {
+	x.owners[ev.Selection] = x.owner(ev.Owner)
 	return xproto.ConvertSelectionChecked(
 		x.conn, ev.Window, ev.Selection, x.atoms.targets, x.atoms.targets, ev.SelectionTimestamp).Check()
 }
 
-func (x *X) GetSelection(ev xproto.SelectionNotifyEvent) ([]uint8, history.ClipFormat, error) {
+// GetSelection handles the owner's reply to a request for the selection. It returns nil until the whole selection has
+// been received, in every target we want to keep.
+func (x *X) GetSelection(ev xproto.SelectionNotifyEvent) (*Selection, error) {
 	if ev.Property == x.atoms.targets {
-		// We had asked for targets, now choose the one we want and request the selection in that format.
-		target, err := x.chooseTarget(ev)
+		// We had asked for targets, now choose the ones we want and request the selection in each of them in turn.
+		target, extras, secret, err := x.chooseTarget(ev)
 		if err != nil {
-			return nil, history.NoneFormat, fmt.Errorf("failed to choose target: %w", err)
+			return nil, fmt.Errorf("failed to choose target: %w", err)
 		}
-		err = xproto.ConvertSelectionChecked(x.conn, ev.Requestor, ev.Selection, target, x.atoms.selectionProperty, ev.Time).Check()
-		if err != nil {
-			return nil, history.NoneFormat, fmt.Errorf("error requesting selection convert to %d, %w", target, err)
+		sel := &Selection{
+			Targets: make(map[string][]byte),
+			Secret:  secret,
+			Owner:   x.owners[ev.Selection],
+			Name:    x.selectionName(ev.Selection),
 		}
-	} else {
-		// We have been given a selection, retrieve it.
-		reply, err := xproto.GetProperty(x.conn, true, ev.Requestor, x.atoms.selectionProperty, AnyProperyType, 0, (1<<32)-1).Reply()
-		if err != nil {
-			return nil, history.NoneFormat, fmt.Errorf("failed to get selection prop: %w", err)
-		}
-		if reply.Type != x.atoms.incr {
-			return reply.Value, x.atomToFormat(reply.Type), nil
+		f := &fetch{
+			sel:     sel,
+			targets: append([]xproto.Atom{target}, extras...),
+			time:    ev.Time,
 		}
+		x.fetches[ev.Selection] = f
+		return nil, x.request(ev.Requestor, ev.Selection, f)
+	}
 
-		// We have an Incr type, delete the property to fire off the incremental write.
-		err = xproto.DeletePropertyChecked(x.conn, ev.Requestor, x.atoms.selectionProperty).Check()
-		if err != nil {
-			return nil, history.NoneFormat, fmt.Errorf("failed to launch INCR read: %w", err)
-		}
+	f, ok := x.fetches[ev.Selection]
+	if !ok || len(f.targets) == 0 || ev.Target != f.targets[0] {
+		// left over from a fetch that has since been replaced by a newer selection
+		return nil, nil
+	}
+	if ev.Property == xproto.AtomNone {
+		// the owner couldn't convert to this target after all
+		return x.received(ev.Requestor, ev.Selection, f, ev.Target, nil)
+	}
 
-		err = x.selectInput(ev.Requestor, xproto.EventMaskPropertyChange)
-		if err != nil {
-			return nil, history.NoneFormat, fmt.Errorf("failed to select input: %w", err)
+	// We have been given a selection, retrieve it.
+	reply, err := xproto.GetProperty(x.conn, true, ev.Requestor, x.atoms.selectionProperty, AnyProperyType, 0, (1<<32)-1).Reply()
+	if err != nil {
+		delete(x.fetches, ev.Selection)
+		return nil, fmt.Errorf("failed to get selection prop: %w", err)
+	}
+	if reply.Type != x.atoms.incr {
+		return x.received(ev.Requestor, ev.Selection, f, reply.Type, reply.Value)
+	}
+
+	// We have an Incr type, delete the property to fire off the incremental write.
+	err = xproto.DeletePropertyChecked(x.conn, ev.Requestor, x.atoms.selectionProperty).Check()
+	if err != nil {
+		delete(x.fetches, ev.Selection)
+		return nil, fmt.Errorf("failed to launch INCR read: %w", err)
+	}
+
+	err = x.selectInput(ev.Requestor, xproto.EventMaskPropertyChange)
+	if err != nil {
+		delete(x.fetches, ev.Selection)
+		return nil, fmt.Errorf("failed to select input: %w", err)
+	}
+
+	cont := incr{
+		data:      make([]byte, 0, unpackInt(reply.Value)),
+		fetch:     f,
+		selection: ev.Selection,
+		target:    ev.Target,
+		property:  x.atoms.selectionProperty,
+	}
+	x.rincrs[ev.Requestor] = &cont
+	return nil, nil
+}
+
+// request asks the owner of the selection to convert it to the next target in f.
+func (x *X) request(window xproto.Window, selection xproto.Atom, f *fetch) error {
+	err := xproto.ConvertSelectionChecked(x.conn, window, selection, f.targets[0], x.atoms.selectionProperty, f.time).Check()
+	if err != nil {
+		delete(x.fetches, selection)
+		return fmt.Errorf("error requesting selection convert to %d, %w", f.targets[0], err)
+	}
+	return nil
+}
+
+// received records data read in the current target of f, and either requests the next target or returns the
+// completed selection.
+func (x *X) received(window xproto.Window, selection xproto.Atom, f *fetch, typ xproto.Atom, data []byte) (*Selection, error) {
+	if !f.primary {
+		f.sel.Data, f.sel.Format = data, x.atomToFormat(typ)
+		if f.sel.Format == history.HtmlFormat {
+			f.sel.Data = decodeHTML(data)
 		}
+		f.primary = true
+	} else if len(data) > 0 {
+		f.sel.Targets[x.getAtomName(f.targets[0])] = data
+	}
 
-		cont := incr{
-			data:      make([]byte, 0, unpackInt(reply.Value)),
-			selection: ev.Selection,
-			target:    ev.Target,
-			property:  x.atoms.selectionProperty,
+	f.targets = f.targets[1:]
+	if len(f.targets) == 0 || f.sel.Data == nil {
+		// without the main target, there is nothing to keep
+		delete(x.fetches, selection)
+		if len(f.sel.Targets) == 0 {
+			f.sel.Targets = nil
 		}
-		x.rincrs[ev.Requestor] = &cont
+		return f.sel, nil
+	}
+	if err := x.request(window, selection, f); err != nil {
+		// we still have the main target, so settle for what we've got
+		return f.sel, err
 	}
-	return nil, history.NoneFormat, nil
+	return nil, nil
 }
 
-func (x *X) SetSelection(ev xproto.SelectionRequestEvent, data *[]uint8, format history.ClipFormat) error {
+// SetSelection answers a SelectionRequestEvent with the contents of c, in the target requested if c has it, or else
+// in its main target.
+func (x *X) SetSelection(ev xproto.SelectionRequestEvent, c *history.Clip) error {
 	replaceProperty := func(typ xproto.Atom, format byte, len uint32, data []byte) error {
 		return xproto.ChangePropertyChecked(
 			x.conn, xproto.PropModeReplace, ev.Requestor, ev.Property,
@@ -196,37 +414,98 @@ func (x *X) SetSelection(ev xproto.SelectionRequestEvent, data *[]uint8, format
 		).Check()
 	}
 
-	var err error
-	var ints []byte
-	dataLen := uint32(len(*data))
 	if ev.Target == x.atoms.targets {
-		ints, err = packInts(uint32(x.formatToAtom(format)), uint32(x.atoms.targets))
+		targets := []xproto.Atom{x.formatToAtom(c.Format), x.atoms.targets}
+		for _, name := range c.TargetNames() {
+			a, err := x.atom(name)
+			if err != nil {
+				return err
+			}
+			targets = append(targets, a)
+		}
+		if c.Format != history.StringFormat && c.Format.IsText() {
+			// we can always make plain text from it
+			for _, a := range []xproto.Atom{x.atoms.utf8, xproto.AtomString} {
+				if !containsAtom(targets, a) {
+					targets = append(targets, a)
+				}
+			}
+		}
+		if c.Format.IsImage() && c.Width > 0 {
+			// we could decode it, so we can convert it to any of the other image formats
+			for _, f := range history.ImageFormats {
+				if a := x.formatToAtom(f); !containsAtom(targets, a) {
+					targets = append(targets, a)
+				}
+			}
+		}
+
+		ints, err := packInts(atomInts(targets)...)
 		if err == nil {
-			err = replaceProperty(xproto.AtomAtom, 32, 2, ints)
-		}
-	} else if int(dataLen) < x.maxPropSize {
-		// TODO: ok, this was the vim issue, we were pasting the wrong target
-		// TODO: vim requested 'Target=_VIMENC_TEXT' despite what we gave it
-		// is our target code wrong, or is vim just ignoring TARGETS?
-		// As long as we TELL it that we are giving it a string, it works.
-		target := x.formatToAtom(format)
-		err = replaceProperty(target, 8, dataLen, []byte(*data))
+			err = replaceProperty(xproto.AtomAtom, 32, uint32(len(targets)), ints)
+		}
+		if err != nil {
+			return err
+		}
+		return x.notify(ev)
+	}
+
+	// Images are converted to whichever image format is asked for. Anything else that isn't one of the other targets
+	// gets the main one, or plain text if the main one is something else that can be shown as text. e.g. vim asks for
+	// _VIMENC_TEXT even when it isn't offered, and as long as we TELL it that we are giving it a string, it works.
+	var src history.ClipReader
+	var size int
+	var err error
+	typ := x.formatToAtom(c.Format)
+	name := ""
+	if len(c.Targets) > 0 {
+		if n := x.getAtomName(ev.Target); c.Targets[n] != nil {
+			typ, name = ev.Target, n
+		}
+	}
+	if f := x.atomToFormat(ev.Target); name == "" && f.IsImage() && c.Format.IsImage() && c.Width > 0 {
+		typ = ev.Target
+		src, size, err = c.OpenImage(f)
+	} else if name == "" && c.Format != history.StringFormat && c.Format.IsText() && ev.Target != x.formatToAtom(c.Format) {
+		typ = xproto.AtomString
+		src, size, err = c.OpenText()
+	} else {
+		src, size, err = c.OpenTarget(name)
+	}
+	if err != nil {
+		return fmt.Errorf("could not open clip: %w", err)
+	}
+
+	var ints []byte
+	if size < x.maxPropSize {
+		data := make([]byte, size)
+		_, err = src.ReadAt(data, 0)
+		src.Close()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("could not read clip: %w", err)
+		}
+		err = replaceProperty(typ, 8, uint32(size), data)
 	} else {
 		// Need to use INCR
-		ints, err = packInts(dataLen)
+		ints, err = packInts(uint32(size))
 		if err == nil {
 			err = replaceProperty(x.atoms.incr, 32, 1, ints)
 		}
 		if err != nil {
+			src.Close()
 			return err
 		}
 		err = x.selectInput(ev.Requestor, xproto.EventMaskPropertyChange)
 
+		if old, ok := x.wincrs[ev.Requestor]; ok {
+			old.src.Close() // abandoned by the requestor
+		}
 		x.wincrs[ev.Requestor] = &incr{
-			data:      []byte(*data),
+			src:       src,
+			size:      size,
 			i:         0,
 			seq:       ev.Sequence,
-			target:    ev.Target,
+			target:    typ,
 			property:  ev.Property,
 			selection: ev.Selection,
 		}
@@ -235,7 +514,11 @@ func (x *X) SetSelection(ev xproto.SelectionRequestEvent, data *[]uint8, format
 	if err != nil {
 		return err
 	}
+	return x.notify(ev)
+}
 
+// notify tells the requestor that the selection they asked for is ready.
+func (x *X) notify(ev xproto.SelectionRequestEvent) error {
 	notifyEvent := xproto.SelectionNotifyEvent{
 		Sequence:  ev.Sequence,
 		Time:      xproto.TimeCurrentTime,
@@ -248,20 +531,22 @@ func (x *X) SetSelection(ev xproto.SelectionRequestEvent, data *[]uint8, format
 	return xproto.SendEventChecked(x.conn, false, ev.Requestor, xproto.EventMaskNoEvent, string(notifyEvent.Bytes())).Check()
 }
 
-func (x *X) ContinueGetSelection(ev xproto.PropertyNotifyEvent) ([]byte, history.ClipFormat, error) {
+// ContinueGetSelection receives the next part of an INCR selection. It returns nil until the whole selection has been
+// received.
+func (x *X) ContinueGetSelection(ev xproto.PropertyNotifyEvent) (*Selection, error) {
 	cont, ok := x.rincrs[ev.Window]
 	if !ok {
-		return nil, history.NoneFormat, fmt.Errorf("could not find INCR to continue: %v", ev)
+		return nil, fmt.Errorf("could not find INCR to continue: %v", ev)
 	}
 
 	reply, err := xproto.GetProperty(x.conn, true, ev.Window, cont.property, AnyProperyType, 0, (1<<32)-1).Reply()
 	if err != nil {
-		return nil, history.NoneFormat, fmt.Errorf("could not get property during incr: %w", err)
+		return nil, fmt.Errorf("could not get property during incr: %w", err)
 	}
 
 	err = xproto.DeletePropertyChecked(x.conn, ev.Window, cont.property).Check()
 	if err != nil {
-		return nil, history.NoneFormat, fmt.Errorf("could not delete property during incr: %w", err)
+		return nil, fmt.Errorf("could not delete property during incr: %w", err)
 	}
 
 	// TODO: prevent it from erroring every time, same method as with SET
@@ -269,13 +554,20 @@ func (x *X) ContinueGetSelection(ev xproto.PropertyNotifyEvent) ([]byte, history
 	if len(reply.Value) == 0 {
 		// we have finished handling this INCR, clean up
 		delete(x.rincrs, ev.Window)
-		err = x.selectInput(ev.Window, xproto.EventMaskNoEvent)
-		return cont.data, x.atomToFormat(cont.target), err
+		if err = x.selectInput(ev.Window, xproto.EventMaskNoEvent); err != nil {
+			delete(x.fetches, cont.selection)
+			return nil, err
+		}
+		if x.fetches[cont.selection] != cont.fetch {
+			// the selection has changed since, so this is out of date
+			return nil, nil
+		}
+		return x.received(ev.Window, cont.selection, cont.fetch, cont.target, cont.data)
 	} else {
 		cont.data = append(cont.data, reply.Value...)
 	}
 
-	return nil, history.NoneFormat, nil
+	return nil, nil
 	// see getAppendProperty https://github.com/kfish/xsel/blob/master/xsel.c
 }
 
@@ -291,10 +583,11 @@ func (x *X) ContinueSetSelection(ev xproto.PropertyNotifyEvent) error {
 	if cont.i < 0 {
 		// we have finished handling this INCR, clean up
 		delete(x.wincrs, ev.Window)
+		cont.src.Close()
 		return x.selectInput(ev.Window, xproto.EventMaskNoEvent)
 	}
 
-	remaining := len(cont.data) - cont.i
+	remaining := cont.size - cont.i
 	dataLen := remaining
 	if remaining > x.maxPropSize {
 		dataLen = x.maxPropSize
@@ -306,9 +599,15 @@ func (x *X) ContinueSetSelection(ev xproto.PropertyNotifyEvent) error {
 		mode = xproto.PropModeReplace
 	}
 
+	// Read a chunk at a time, so that large clips held on disk never need to be in memory all at once
+	chunk := make([]byte, dataLen)
+	if _, err := cont.src.ReadAt(chunk, int64(cont.i)); err != nil && err != io.EOF {
+		return fmt.Errorf("could not read clip during INCR: %w", err)
+	}
+
 	err := xproto.ChangePropertyChecked(
 		x.conn, byte(mode), ev.Window, cont.property, cont.target,
-		8, uint32(dataLen), cont.data[cont.i:cont.i+dataLen],
+		8, uint32(dataLen), chunk,
 	).Check()
 	if err != nil {
 		return fmt.Errorf("could not write property during INCR: %w", err)
@@ -324,12 +623,42 @@ func (x *X) ContinueSetSelection(ev xproto.PropertyNotifyEvent) error {
 	return nil
 }
 
+// BecomeSelectionOwner takes both PRIMARY and CLIPBOARD.
 func (x *X) BecomeSelectionOwner() error {
-	err := xproto.SetSelectionOwnerChecked(x.conn, x.window, xproto.AtomPrimary, xproto.TimeCurrentTime).Check()
-	if err != nil {
-		return err
+	return x.TakeSelections("PRIMARY", "CLIPBOARD")
+}
+
+// TakeSelections becomes the owner of the named selections, so that what is pasted from them comes from us.
+func (x *X) TakeSelections(names ...string) error {
+	for _, name := range names {
+		sel, err := x.atom(name)
+		if err != nil {
+			return err
+		}
+		err = xproto.SetSelectionOwnerChecked(x.conn, x.window, sel, xproto.TimeCurrentTime).Check()
+		if err != nil {
+			return err
+		}
 	}
-	return xproto.SetSelectionOwnerChecked(x.conn, x.window, x.atoms.clipboard, xproto.TimeCurrentTime).Check()
+	return nil
+}
+
+// DropSelectionOwner gives up any selections we own, so that nothing is pasted until something else is copied.
+func (x *X) DropSelectionOwner() error {
+	for _, sel := range []xproto.Atom{xproto.AtomPrimary, x.atoms.clipboard} {
+		reply, err := xproto.GetSelectionOwner(x.conn, sel).Reply()
+		if err != nil {
+			return err
+		}
+		if reply.Owner != x.window {
+			continue
+		}
+		err = xproto.SetSelectionOwnerChecked(x.conn, xproto.WindowNone, sel, xproto.TimeCurrentTime).Check()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (x *X) DumpEvent(event *xgb.Event) string {
@@ -374,6 +703,19 @@ func (x *X) getAtomName(atom xproto.Atom) string {
 	return r.Name
 }
 
+// selectionName returns the name of a selection atom, without asking the server for the usual ones.
+func (x *X) selectionName(selection xproto.Atom) string {
+	switch selection {
+	case x.atoms.clipboard:
+		return "CLIPBOARD"
+	case xproto.AtomPrimary:
+		return "PRIMARY"
+	case xproto.AtomSecondary:
+		return "SECONDARY"
+	}
+	return x.getAtomName(selection)
+}
+
 func (x *X) atomToFormat(atom xproto.Atom) history.ClipFormat {
 	if atom == x.atoms.utf8 || atom == xproto.AtomString {
 		return history.StringFormat
@@ -381,6 +723,21 @@ func (x *X) atomToFormat(atom xproto.Atom) history.ClipFormat {
 	if atom == x.atoms.png {
 		return history.PngFormat
 	}
+	if atom == x.atoms.html {
+		return history.HtmlFormat
+	}
+	if atom == x.atoms.uriList {
+		return history.FilesFormat
+	}
+	if atom == x.atoms.jpeg {
+		return history.JpegFormat
+	}
+	if atom == x.atoms.gif {
+		return history.GifFormat
+	}
+	if atom == x.atoms.bmp {
+		return history.BmpFormat
+	}
 	return history.NoneFormat
 }
 
@@ -388,6 +745,21 @@ func (x *X) formatToAtom(f history.ClipFormat) xproto.Atom {
 	if f == history.PngFormat {
 		return x.atoms.png
 	}
+	if f == history.HtmlFormat {
+		return x.atoms.html
+	}
+	if f == history.FilesFormat {
+		return x.atoms.uriList
+	}
+	if f == history.JpegFormat {
+		return x.atoms.jpeg
+	}
+	if f == history.GifFormat {
+		return x.atoms.gif
+	}
+	if f == history.BmpFormat {
+		return x.atoms.bmp
+	}
 	return xproto.AtomString
 }
 
@@ -399,6 +771,32 @@ func createAtom(X *xgb.Conn, n string) xproto.Atom {
 	return reply.Atom
 }
 
+// decodeHTML converts HTML to UTF-8 if it is UTF-16 with a byte order mark, as some browsers send it.
+func decodeHTML(data []byte) []byte {
+	var order binary.ByteOrder
+	if bytes.HasPrefix(data, []byte{0xff, 0xfe}) {
+		order = binary.LittleEndian
+	} else if bytes.HasPrefix(data, []byte{0xfe, 0xff}) {
+		order = binary.BigEndian
+	} else {
+		return data
+	}
+
+	units := make([]uint16, (len(data)-2)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2+i*2:])
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+func atomInts(atoms []xproto.Atom) []uint32 {
+	ints := make([]uint32, len(atoms))
+	for i, a := range atoms {
+		ints[i] = uint32(a)
+	}
+	return ints
+}
+
 func packInts(ints ...uint32) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.LittleEndian, ints)
@@ -415,10 +813,12 @@ func unpackInt(packed []byte) uint32 {
 	return binary.LittleEndian.Uint32(packed[0:4])
 }
 
-func (x *X) chooseTarget(ev xproto.SelectionNotifyEvent) (xproto.Atom, error) {
+// chooseTarget picks the main target to request the selection in from those offered, along with any others we want
+// to keep, and reports whether any of them mark the selection as secret.
+func (x *X) chooseTarget(ev xproto.SelectionNotifyEvent) (xproto.Atom, []xproto.Atom, bool, error) {
 	reply, err := xproto.GetProperty(x.conn, true, ev.Requestor, x.atoms.targets, xproto.AtomAtom, 0, (1<<32)-1).Reply()
 	if err != nil {
-		return xproto.AtomNone, err
+		return xproto.AtomNone, nil, false, err
 	}
 
 	atomsBytes := bytes.NewReader(reply.Value)
@@ -426,7 +826,7 @@ func (x *X) chooseTarget(ev xproto.SelectionNotifyEvent) (xproto.Atom, error) {
 	err = binary.Read(atomsBytes, binary.LittleEndian, &atoms)
 
 	if err != nil {
-		return xproto.AtomNone, err
+		return xproto.AtomNone, nil, false, err
 	}
 
 	// TODO: give x a logger?
@@ -435,10 +835,68 @@ func (x *X) chooseTarget(ev xproto.SelectionNotifyEvent) (xproto.Atom, error) {
 		fmt.Printf("Available target: %s\n", name)
 	}
 
+	// Whether we take an image or text is up to the owner: whichever it lists first. Some offer a picture of their
+	// text, and some a description of their picture. Within each, we prefer the richer targets.
+	images := []xproto.Atom{x.atoms.png, x.atoms.jpeg, x.atoms.gif, x.atoms.bmp}
+	texts := []xproto.Atom{x.atoms.uriList, x.atoms.html, x.atoms.utf8}
+	var target xproto.Atom = xproto.AtomString
 	for _, a := range atoms {
-		if a == x.atoms.png || a == x.atoms.utf8 {
-			return a, nil
+		kind := images
+		if containsAtom(texts, a) {
+			kind = texts
+		} else if !containsAtom(images, a) {
+			continue
+		}
+		for _, want := range kind {
+			if containsAtom(atoms, want) {
+				target = want
+				break
+			}
+		}
+		break
+	}
+
+	secret := false
+	var extras []xproto.Atom
+	for _, a := range atoms {
+		if containsAtom(x.secretTargets, a) {
+			secret = true
+		}
+		if a != target && containsAtom(x.keepTargets, a) {
+			extras = append(extras, a)
 		}
 	}
-	return xproto.AtomString, nil
+	if (target == x.atoms.html || target == x.atoms.uriList) && containsAtom(atoms, x.atoms.utf8) {
+		// the owner's own plain text is better than anything we can make from the HTML
+		extras = append(extras, x.atoms.utf8)
+	}
+	return target, extras, secret, nil
+}
+
+func containsAtom(atoms []xproto.Atom, a xproto.Atom) bool {
+	for _, aa := range atoms {
+		if aa == a {
+			return true
+		}
+	}
+	return false
+}
+
+// atom returns the atom with the given name, creating it if need be.
+func (x *X) atom(name string) (xproto.Atom, error) {
+	x.namedMu.Lock()
+	a, ok := x.named[name]
+	x.namedMu.Unlock()
+	if ok {
+		return a, nil
+	}
+
+	a = createAtom(x.conn, name)
+	if a == xproto.AtomNone {
+		return a, fmt.Errorf("could not create atom for %s", name)
+	}
+	x.namedMu.Lock()
+	x.named[name] = a
+	x.namedMu.Unlock()
+	return a, nil
 }